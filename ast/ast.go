@@ -2,33 +2,227 @@ package ast
 
 import (
 	"fmt"
+	"os"
 	"strings"
 	"time"
 )
 
+// Overlap decides what happens when a repeating command is due
+// while its previous run is still going.
+type Overlap uint8
+
+const (
+	// skip the run
+	OverlapSkip Overlap = iota
+	// run it after the previous run finishes
+	OverlapQueue
+	// run it alongside the previous run
+	OverlapParallel
+	// stop the previous run and start a new one
+	OverlapReplace
+)
+
+func (o Overlap) String() string {
+	switch o {
+	case OverlapSkip:
+		return "skip"
+	case OverlapQueue:
+		return "queue"
+	case OverlapParallel:
+		return "parallel"
+	case OverlapReplace:
+		return "replace"
+	default:
+		return fmt.Sprintf("Overlap(%d)", o)
+	}
+}
+
+// Singleton decides what happens when a script is started while another instance of it is running.
+type Singleton uint8
+
+const (
+	// allow several instances
+	SingletonOff Singleton = iota
+	// exit right away
+	SingletonExit
+	// wait for the other instance to finish
+	SingletonWait
+	// stop the other instance and take its place
+	SingletonReplace
+)
+
+func (s Singleton) String() string {
+	switch s {
+	case SingletonOff:
+		return "off"
+	case SingletonExit:
+		return "exit"
+	case SingletonWait:
+		return "wait"
+	case SingletonReplace:
+		return "replace"
+	default:
+		return fmt.Sprintf("Singleton(%d)", s)
+	}
+}
+
+// Timestamps decides how the lines a command outputs are timestamped.
+type Timestamps uint8
+
+const (
+	// no timestamps
+	TimestampsOff Timestamps = iota
+	// the local date and time
+	TimestampsLocal
+	// the time in RFC 3339 format
+	TimestampsRFC3339
+	// the time since the run started
+	TimestampsElapsed
+)
+
+func (t Timestamps) String() string {
+	switch t {
+	case TimestampsOff:
+		return "off"
+	case TimestampsLocal:
+		return "true"
+	case TimestampsRFC3339:
+		return "rfc3339"
+	case TimestampsElapsed:
+		return "elapsed"
+	default:
+		return fmt.Sprintf("Timestamps(%d)", t)
+	}
+}
+
+// Redirect is a destination of the output of a command:
+// a file, or one of the special targets such as !stdout.
+type Redirect struct {
+	Target string `json:"target"`
+	// append to the file instead of truncating it
+	Append bool `json:"append,omitempty"`
+}
+
+func (r Redirect) String() string {
+	if r.Append {
+		return ">> " + r.Target
+	}
+	return r.Target
+}
+
+// Rotation decides when the files a command writes to are rotated.
+type Rotation struct {
+	// rotate a file before it grows past this many bytes, 0 means no limit
+	Size int64 `json:"size,omitempty"`
+	// rotate a file when it's written to on a new day
+	Daily bool `json:"daily,omitempty"`
+	// how many rotated files are kept, 0 means all of them
+	Keep int `json:"keep,omitempty"`
+	// gzip the rotated files
+	Compress bool `json:"compress,omitempty"`
+}
+
+// Enabled reports whether files are rotated at all.
+func (r Rotation) Enabled() bool {
+	return r.Size > 0 || r.Daily
+}
+
+// Settings holds the script-wide settings set by directives.
+type Settings struct {
+	// MaxParallel limits how many commands may run at once, 0 means no limit.
+	MaxParallel int `json:"maxParallel,omitempty"`
+	// Pools maps pool names to the number of commands that may run in them at once.
+	Pools map[string]int `json:"pools,omitempty"`
+	// Singleton guards against running several instances of the script at once.
+	Singleton Singleton `json:"singleton,omitempty"`
+}
+
+// Command is a command of a script, with the directives in effect where it appears already applied.
+// Durations are encoded in JSON as strings such as "1m30s".
 type Command struct {
-	Command               string
-	Args                  []string
-	Dir                   string
-	Name                  string
-	Stdin, Stdout, Stderr string
-	Sync                  bool
-	Every                 time.Duration
-	Times                 int
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	Dir     string   `json:"dir,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Stdin   string   `json:"stdin,omitempty"`
+	// text given to the command as its stdin, instead of Stdin
+	Input    string        `json:"input,omitempty"`
+	Stdout   []Redirect    `json:"stdout,omitempty"`
+	Stderr   []Redirect    `json:"stderr,omitempty"`
+	Sync     bool          `json:"sync,omitempty"`
+	Every    time.Duration `json:"every,omitempty"`
+	Times    int           `json:"times,omitempty"`
+	Overlap  Overlap       `json:"overlap,omitempty"`
+	Jitter   time.Duration `json:"jitter,omitempty"`
+	Splay    time.Duration `json:"splay,omitempty"`
+	Pool     string        `json:"pool,omitempty"`
+	Priority int           `json:"priority,omitempty"`
+	Lock     string        `json:"lock,omitempty"`
+	LockFile string        `json:"lockFile,omitempty"`
+	// permissions of created files, 0 means the default
+	FileMode os.FileMode `json:"fileMode,omitempty"`
+	// create the missing parent directories of redirect files
+	Mkdir bool `json:"mkdir,omitempty"`
+	// rotation of redirect files
+	Rotate Rotation `json:"rotate"`
+	// written before every line of output
+	Prefix     string     `json:"prefix,omitempty"`
+	Timestamps Timestamps `json:"timestamps,omitempty"`
+	// the line the command starts on, ignored by Equal
+	Line int `json:"line"`
+}
+
+// Variable is a variable assignment, such as x:=42.
+type Variable struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Line  int    `json:"line"`
+}
+
+// Program is a whole parsed script.
+type Program struct {
+	// the settings set by the directives of the script
+	Settings  Settings   `json:"settings"`
+	Variables []Variable `json:"variables"`
+	Commands  []*Command `json:"commands"`
 }
 
 func (a Command) Equal(b Command) bool {
 	if a.Name != b.Name ||
 		a.Command != b.Command ||
 		a.Stdin != b.Stdin ||
-		a.Stdout != b.Stdout ||
+		a.Input != b.Input ||
 		a.Dir != b.Dir ||
 		a.Sync != b.Sync ||
 		a.Every != b.Every ||
 		a.Times != b.Times ||
-		len(a.Args) != len(b.Args) {
+		a.Overlap != b.Overlap ||
+		a.Jitter != b.Jitter ||
+		a.Splay != b.Splay ||
+		a.Pool != b.Pool ||
+		a.Priority != b.Priority ||
+		a.Lock != b.Lock ||
+		a.LockFile != b.LockFile ||
+		a.FileMode != b.FileMode ||
+		a.Mkdir != b.Mkdir ||
+		a.Rotate != b.Rotate ||
+		a.Prefix != b.Prefix ||
+		a.Timestamps != b.Timestamps ||
+		len(a.Args) != len(b.Args) ||
+		len(a.Stdout) != len(b.Stdout) ||
+		len(a.Stderr) != len(b.Stderr) {
 		return false
 	}
+	for i, r := range a.Stdout {
+		if r != b.Stdout[i] {
+			return false
+		}
+	}
+	for i, r := range a.Stderr {
+		if r != b.Stderr[i] {
+			return false
+		}
+	}
 	for i, arg := range a.Args {
 		if arg != b.Args[i] {
 			return false
@@ -53,11 +247,29 @@ func (c Command) GoString() string {
 	if c.Stdin != "" {
 		fmt.Fprintf(&buff, "\tStdin: %q,\n", c.Stdin)
 	}
-	if c.Stdout != "" {
-		fmt.Fprintf(&buff, "\tStdout: %q,\n", c.Stdout)
+	if c.Input != "" {
+		fmt.Fprintf(&buff, "\tInput: %q,\n", c.Input)
 	}
-	if c.Stderr != "" {
-		fmt.Fprintf(&buff, "\tStderr: %q,\n", c.Stderr)
+	if len(c.Stdout) > 0 {
+		fmt.Fprintf(&buff, "\tStdout: %v,\n", c.Stdout)
+	}
+	if len(c.Stderr) > 0 {
+		fmt.Fprintf(&buff, "\tStderr: %v,\n", c.Stderr)
+	}
+	if c.FileMode != 0 {
+		fmt.Fprintf(&buff, "\tFileMode: %#o,\n", c.FileMode)
+	}
+	if c.Mkdir {
+		fmt.Fprintf(&buff, "\tMkdir: %t,\n", c.Mkdir)
+	}
+	if c.Rotate != (Rotation{}) {
+		fmt.Fprintf(&buff, "\tRotate: %+v,\n", c.Rotate)
+	}
+	if c.Prefix != "" {
+		fmt.Fprintf(&buff, "\tPrefix: %q,\n", c.Prefix)
+	}
+	if c.Timestamps != TimestampsOff {
+		fmt.Fprintf(&buff, "\tTimestamps: %s,\n", c.Timestamps)
 	}
 	if c.Every > 0 {
 		fmt.Fprintf(&buff, "\tEvery: %d,\n", c.Every)
@@ -65,6 +277,27 @@ func (c Command) GoString() string {
 	if c.Times > 0 {
 		fmt.Fprintf(&buff, "\tTimes: %d,\n", c.Times)
 	}
+	if c.Overlap != OverlapSkip {
+		fmt.Fprintf(&buff, "\tOverlap: %s,\n", c.Overlap)
+	}
+	if c.Jitter > 0 {
+		fmt.Fprintf(&buff, "\tJitter: %d,\n", c.Jitter)
+	}
+	if c.Splay > 0 {
+		fmt.Fprintf(&buff, "\tSplay: %d,\n", c.Splay)
+	}
+	if c.Pool != "" {
+		fmt.Fprintf(&buff, "\tPool: %q,\n", c.Pool)
+	}
+	if c.Priority != 0 {
+		fmt.Fprintf(&buff, "\tPriority: %d,\n", c.Priority)
+	}
+	if c.Lock != "" {
+		fmt.Fprintf(&buff, "\tLock: %q,\n", c.Lock)
+	}
+	if c.LockFile != "" {
+		fmt.Fprintf(&buff, "\tLockFile: %q,\n", c.LockFile)
+	}
 	buff.WriteRune('}')
 	return buff.String()
 }
@@ -0,0 +1,97 @@
+package ast
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The enums are encoded in JSON as the strings they're written as in scripts.
+
+func (o Overlap) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+func (o *Overlap) UnmarshalText(text []byte) error {
+	for v := OverlapSkip; v <= OverlapReplace; v++ {
+		if v.String() == string(text) {
+			*o = v
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid overlap %q", text)
+}
+
+func (s Singleton) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Singleton) UnmarshalText(text []byte) error {
+	for v := SingletonOff; v <= SingletonReplace; v++ {
+		if v.String() == string(text) {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid singleton mode %q", text)
+}
+
+func (t Timestamps) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *Timestamps) UnmarshalText(text []byte) error {
+	for v := TimestampsOff; v <= TimestampsElapsed; v++ {
+		if v.String() == string(text) {
+			*t = v
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid timestamps %q", text)
+}
+
+// duration is a time.Duration encoded as a string such as "1m30s".
+type duration time.Duration
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	*d = duration(v)
+	return err
+}
+
+// command has the fields of Command without its methods,
+// so the JSON methods of Command can encode it with the default encoding.
+type command Command
+
+// commandJSON is how a Command is encoded in JSON;
+// its durations shadow the ones of the embedded command.
+type commandJSON struct {
+	*command
+	Every  duration `json:"every,omitempty"`
+	Jitter duration `json:"jitter,omitempty"`
+	Splay  duration `json:"splay,omitempty"`
+}
+
+func (c Command) MarshalJSON() ([]byte, error) {
+	return json.Marshal(commandJSON{
+		command: (*command)(&c),
+		Every:   duration(c.Every),
+		Jitter:  duration(c.Jitter),
+		Splay:   duration(c.Splay),
+	})
+}
+
+func (c *Command) UnmarshalJSON(data []byte) error {
+	v := commandJSON{command: (*command)(c)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	c.Every = time.Duration(v.Every)
+	c.Jitter = time.Duration(v.Jitter)
+	c.Splay = time.Duration(v.Splay)
+	return nil
+}
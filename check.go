@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/insomnimus/inscript/ast"
+	"github.com/insomnimus/inscript/jobfile"
+	"github.com/insomnimus/inscript/lexer"
+	"github.com/insomnimus/inscript/parser"
+	"github.com/insomnimus/inscript/runtime"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileDiagnostic is a diagnostic of a checked file.
+type fileDiagnostic struct {
+	File string `json:"file"`
+	runtime.Diagnostic
+}
+
+// check runs the check subcommand with the arguments following it.
+// It exits with status 1 if any file has errors.
+func check(argv []string) {
+	var (
+		minInterval durationFlag
+		format      formatFlag
+		asJSON      bool
+	)
+	flags := flag.NewFlagSet("inscript check", flag.ContinueOnError)
+	flags.Usage = func() {}
+	flags.Var(&minInterval, "min-interval", "")
+	flags.Var(&format, "format", "")
+	flags.BoolVar(&asJSON, "json", false, "")
+	if err := flags.Parse(argv); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			showHelp()
+		}
+		log.Fatal(usage)
+	}
+	if flags.NArg() == 0 {
+		log.Fatal(usage)
+	}
+
+	ds := make([]fileDiagnostic, 0)
+	failed := false
+	for _, path := range flags.Args() {
+		for _, d := range checkFile(path, format, minInterval) {
+			failed = failed || d.Severity == runtime.SeverityError
+			ds = append(ds, fileDiagnostic{File: path, Diagnostic: d})
+		}
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(ds); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		for _, d := range ds {
+			if d.Line > 0 {
+				fmt.Printf("%s:%d: %s: %s\n", d.File, d.Line, d.Severity, d.Message)
+			} else {
+				fmt.Printf("%s: %s: %s\n", d.File, d.Severity, d.Message)
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// checkFile parses the script at path without running anything and returns its problems,
+// sorted by line.
+func checkFile(path string, format formatFlag, minInterval durationFlag) []runtime.Diagnostic {
+	// diagnostics count lines from 1, like job files, while the lexer counts them from 0
+	shift := 1
+	fail := func(err error) []runtime.Diagnostic {
+		line, msg := splitLine(err.Error())
+		if line < 0 {
+			line = 0
+		} else {
+			line += shift
+		}
+		return []runtime.Diagnostic{{Line: line, Severity: runtime.SeverityError, Message: msg}}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fail(err)
+	}
+	// the variables of a script are set in the environment, which the next file mustn't see
+	defer parser.RestoreEnv(os.Environ())
+	os.Setenv("0", path)
+	os.Setenv("#", "0")
+	os.Setenv("@", "")
+
+	var (
+		prog *ast.Program
+		l    *lexer.Lexer
+	)
+	if f, ok := format.of(path); ok {
+		shift = 0
+		p := parser.NewStructured()
+		if minInterval.set {
+			p.SetMinInterval(minInterval.d)
+		}
+		if prog, err = jobfile.Parse(p, data, f); err != nil {
+			return fail(err)
+		}
+	} else {
+		l = lexer.NewMode(string(data), lexer.NoEval)
+		p, err := parser.New(l)
+		if err != nil {
+			return fail(err)
+		}
+		if minInterval.set {
+			p.SetMinInterval(minInterval.d)
+		}
+		if prog, err = p.Program(); err != nil {
+			return fail(err)
+		}
+	}
+
+	for _, cmd := range prog.Commands {
+		cmd.Line += shift
+	}
+	for i := range prog.Variables {
+		prog.Variables[i].Line += shift
+	}
+
+	r := runtime.NewRunner(prog.Settings)
+	r.Dir = filepath.Dir(path)
+	ds := r.Check(prog.Commands)
+	// job files have no variables
+	for _, v := range prog.Variables {
+		if !l.Referenced(v.Name) && !mentions(prog.Commands, v.Name) {
+			ds = append(ds, runtime.Diagnostic{
+				Line:     v.Line,
+				Severity: runtime.SeverityWarning,
+				Message:  fmt.Sprintf("variable %s is never used", v.Name),
+			})
+		}
+	}
+	sort.SliceStable(ds, func(i, j int) bool {
+		return ds[i].Line < ds[j].Line
+	})
+	return ds
+}
+
+// mentions reports whether $name or ${name} is left in the text of a command,
+// such as in a single quoted argument to a shell.
+func mentions(cmds []*ast.Command, name string) bool {
+	found := false
+	mapping := func(s string) string {
+		found = found || s == name
+		return ""
+	}
+	for _, cmd := range cmds {
+		for _, s := range append([]string{cmd.Command, cmd.Stdin, cmd.Input, cmd.Dir}, cmd.Args...) {
+			os.Expand(s, mapping)
+		}
+	}
+	return found
+}
+
+// splitLine splits "line N: message" into N and the message, or returns -1 and msg if it has no line.
+func splitLine(msg string) (int, string) {
+	var line int
+	if _, err := fmt.Sscanf(msg, "line %d:", &line); err != nil {
+		return -1, msg
+	}
+	return line, strings.TrimSpace(msg[strings.IndexByte(msg, ':')+1:])
+}
@@ -0,0 +1,274 @@
+// Package crontab translates crontabs into scripts.
+//
+// An entry is translated into a command block running the command with the shell, as cron does,
+// if inscript can run it on the same schedule: every:= ticks are aligned to UTC,
+// or to midnight in the local time zone for intervals of a day or more,
+// so only schedules whose runs are evenly spaced and fall on those ticks in the time zone of the crontab are.
+// The other entries are kept as comments, with a warning saying why they couldn't be translated.
+package crontab
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/insomnimus/inscript/printer"
+	"strings"
+	"time"
+)
+
+type translator struct {
+	w   *bytes.Buffer
+	loc *time.Location
+	// the shell the commands are run with, a reference to the SHELL variable once the crontab sets it
+	shell string
+	// to whom cron would mail the output of the entries, if anyone
+	mail string
+	// the mail warning was written for the current MAILTO
+	warned bool
+	// the output is written to inscript's own
+	redirected bool
+}
+
+// Translate translates the crontab src into a script.
+// loc is the time zone the entries are scheduled in, unless the crontab sets CRON_TZ.
+func Translate(src []byte, loc *time.Location) ([]byte, error) {
+	t := &translator{
+		w:     &bytes.Buffer{},
+		loc:   loc,
+		shell: "/bin/sh",
+		mail:  "the owner of the crontab",
+	}
+	// cron runs the commands in the home directory
+	t.w.WriteString("#<dir=~>\n")
+	sc := bufio.NewScanner(bytes.NewReader(src))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		t.line(sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return printer.Format(t.w.Bytes())
+}
+
+func (t *translator) line(line string) {
+	trimmed := strings.TrimSpace(line)
+	switch {
+	case trimmed == "":
+		t.w.WriteString("\n")
+	case trimmed[0] == '#':
+		t.comment(trimmed)
+	default:
+		if name, val, ok := assignment(trimmed); ok {
+			t.assign(name, val, trimmed)
+		} else {
+			t.entry(trimmed)
+		}
+	}
+}
+
+// assignment splits an environment assignment such as NAME = value,
+// removing the quotes around the value, if any.
+func assignment(line string) (name, val string, ok bool) {
+	i := strings.IndexByte(line, '=')
+	if i <= 0 {
+		return "", "", false
+	}
+	name = strings.TrimSpace(line[:i])
+	for j, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || j > 0 && c >= '0' && c <= '9') {
+			return "", "", false
+		}
+	}
+	val = strings.TrimSpace(line[i+1:])
+	if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+		val = val[1 : len(val)-1]
+	}
+	return name, val, true
+}
+
+func (t *translator) assign(name, val, line string) {
+	switch name {
+	case "MAILTO":
+		t.mail, t.warned = val, false
+		t.comment(line)
+		// the output is discarded, as inscript does by default
+		if val == "" && t.redirected {
+			t.redirected = false
+			t.w.WriteString("#<stdout=>\n#<stderr=>\n")
+		}
+		return
+	case "CRON_TZ":
+		t.comment(line)
+		loc, err := time.LoadLocation(val)
+		if err != nil {
+			t.warn(fmt.Sprintf("unknown time zone %q, the entries below are checked against %s", val, t.loc))
+			return
+		}
+		t.loc = loc
+		return
+	case "SHELL":
+		t.shell = "$SHELL"
+	}
+	fmt.Fprintf(t.w, "%s:= %s\n", name, quote(val))
+}
+
+func (t *translator) warn(msg string) {
+	t.w.WriteString("# warning: " + msg + "\n")
+}
+
+// skip writes an entry that can't be translated as a comment, with the reason why.
+func (t *translator) skip(line, reason string) {
+	t.warn("can't translate this entry exactly: " + reason)
+	t.comment(line)
+}
+
+// comment writes s as a comment.
+func (t *translator) comment(s string) {
+	s = strings.TrimSpace(strings.TrimPrefix(s, "#"))
+	// it mustn't be read as a directive
+	if strings.HasPrefix(s, "<") && strings.HasSuffix(s, ">") && strings.Contains(s, "=") {
+		s += " (not a directive)"
+	}
+	t.w.WriteString("# " + s + "\n")
+}
+
+func (t *translator) entry(line string) {
+	var (
+		spec    string
+		command string
+	)
+	if line[0] == '@' {
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			t.skip(line, "missing command")
+			return
+		}
+		spec, command = line[:i], strings.TrimSpace(line[i:])
+	} else {
+		// the command is the rest of the line after the five time fields
+		rest := line
+		for n := 0; n < 5; n++ {
+			rest = strings.TrimLeft(rest, " \t")
+			i := strings.IndexAny(rest, " \t")
+			if i < 0 {
+				t.skip(line, "expected five time fields and a command")
+				return
+			}
+			rest = rest[i:]
+		}
+		spec, command = strings.TrimSpace(line[:len(line)-len(rest)]), strings.TrimSpace(rest)
+	}
+
+	// @reboot entries run once, when started
+	every := ""
+	if lower := strings.ToLower(spec); lower != "@reboot" {
+		if lower[0] == '@' {
+			if spec = macros[lower]; spec == "" {
+				t.skip(line, fmt.Sprintf("unknown macro %s", lower))
+				return
+			}
+		}
+		s, err := parseSchedule(strings.Fields(spec))
+		if err != nil {
+			t.skip(line, err.Error())
+			return
+		}
+		interval, phase, reason := s.interval()
+		if reason != "" {
+			t.skip(line, reason)
+			return
+		}
+		if !aligned(interval, phase, t.loc) {
+			t.skip(line, fmt.Sprintf("inscript runs jobs every %s at times aligned to %s, which this schedule doesn't match in %s",
+				formatInterval(interval), alignment(interval), t.loc))
+			return
+		}
+		every = formatInterval(interval)
+	}
+
+	if t.mail != "" && !t.warned {
+		t.warned = true
+		t.warn(fmt.Sprintf("cron mails the output of the entries below to %s; inscript can't, so it's written to its own output instead", t.mail))
+		if !t.redirected {
+			t.redirected = true
+			t.w.WriteString("#<stdout=!stdout>\n#<stderr=!stderr>\n")
+		}
+	}
+	command, input, hasInput := splitInput(command)
+	t.comment(line)
+	if every == "" && !hasInput {
+		fmt.Fprintf(t.w, "%s -c %s\n", t.shell, quote(command))
+		return
+	}
+	fmt.Fprintf(t.w, "@ %s -c %s {\n", t.shell, quote(command))
+	if every != "" {
+		fmt.Fprintf(t.w, "every:= %s\n", every)
+		// cron starts every run, even if the previous one is still running
+		t.w.WriteString("overlap:= parallel\n")
+	}
+	if hasInput {
+		fmt.Fprintf(t.w, "input:= %s\n", quote(input))
+	}
+	t.w.WriteString("}\n")
+}
+
+// splitInput splits the command of an entry at its first unescaped '%':
+// the text after it is given to the command as its input, with the rest of the '%'s changed into line feeds.
+// Escaped '%'s lose their backslash.
+func splitInput(s string) (command, input string, ok bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == '%':
+			b.WriteByte('%')
+			i++
+		case s[i] == '%' && ok:
+			b.WriteByte('\n')
+		case s[i] == '%':
+			command = b.String()
+			b.Reset()
+			ok = true
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	if !ok {
+		return b.String(), "", false
+	}
+	return command, b.String(), true
+}
+
+// quote returns s as a word that is read as s, quoting it if it needs to be.
+func quote(s string) string {
+	bare := s != ""
+	for _, c := range s {
+		if !(c == '/' || c == '.' || c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			bare = false
+			break
+		}
+	}
+	switch {
+	case bare:
+		return s
+	case !strings.ContainsAny(s, "\"\\$\n"):
+		return `"` + s + `"`
+	case !strings.ContainsAny(s, "'\\\n"):
+		return "'" + s + "'"
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch c {
+		case '"', '\\', '$':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,159 @@
+package crontab
+
+import (
+	"github.com/insomnimus/inscript/lexer"
+	"github.com/insomnimus/inscript/parser"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranslate(t *testing.T) {
+	src := `# backups
+SHELL=/bin/bash
+MAILTO=""
+*/15 * * * * poll --quiet
+0 * * * * echo "$(date +\%H) o'clock" >> hours.log
+@daily backup % one%two\%
+@reboot start-agent
+0 0 * * 1 weekly
+30 2 * * 1-5 weekdays
+0 0 1 * * monthly
+MAILTO=ops@example.com
+@hourly report
+`
+	want := `#<dir=~>
+# backups
+SHELL:= /bin/bash
+# MAILTO=""
+# */15 * * * * poll --quiet
+@ $SHELL -c "poll --quiet" {
+	every:= 15m
+	overlap:= parallel
+}
+# 0 * * * * echo "$(date +\%H) o'clock" >> hours.log
+@ $SHELL -c "echo \"\$(date +%H) o'clock\" >> hours.log" {
+	every:= 1h
+	overlap:= parallel
+}
+# @daily backup % one%two\%
+@ $SHELL -c "backup " {
+	every:= 1d
+	overlap:= parallel
+	input:= " one\ntwo%"
+}
+# @reboot start-agent
+$SHELL -c start-agent
+# 0 0 * * 1 weekly
+@ $SHELL -c weekly {
+	every:= 1w
+	overlap:= parallel
+}
+# warning: can't translate this entry exactly: the runs aren't evenly spaced
+# 30 2 * * 1-5 weekdays
+# warning: can't translate this entry exactly: inscript can't schedule by the day of the month or the month
+# 0 0 1 * * monthly
+# MAILTO=ops@example.com
+# warning: cron mails the output of the entries below to ops@example.com; inscript can't, so it's written to its own output instead
+#<stdout=!stdout>
+#<stderr=!stderr>
+# @hourly report
+@ $SHELL -c report {
+	every:= 1h
+	overlap:= parallel
+}
+`
+	// days and weeks are aligned to the local time zone, which the crontab must be in
+	defer func(local *time.Location) {
+		time.Local = local
+	}(time.Local)
+	time.Local = time.UTC
+	got, err := Translate([]byte(src), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("mismatch:\nexpected:\n%s\ngot:\n%s", want, got)
+	}
+
+	defer parser.RestoreEnv(os.Environ())
+	l := lexer.NewMode(string(got), lexer.NoEval)
+	prog, err := parser.Parse(l)
+	if err != nil {
+		t.Fatalf("the translation doesn't parse: %s", err)
+	}
+	if n := len(prog.Commands); n != 6 {
+		t.Errorf("expected 6 commands, got %d", n)
+	}
+	for _, cmd := range prog.Commands {
+		if cmd.Command != "/bin/bash" {
+			t.Errorf("expected the commands to run with the shell of the crontab, got %s", cmd.Command)
+		}
+	}
+	if !l.Referenced("SHELL") {
+		t.Error("expected the SHELL variable to be used")
+	}
+	if cmd := prog.Commands[1]; cmd.Args[1] != `echo "$(date +%H) o'clock" >> hours.log` {
+		t.Errorf("the command of the second entry changed: %q", cmd.Args[1])
+	}
+}
+
+func TestAlignment(t *testing.T) {
+	plus2 := time.FixedZone("UTC+2", 2*60*60)
+	nepal := time.FixedZone("UTC+5:45", (5*60+45)*60)
+	// days and weeks are aligned to the local time zone
+	defer func(local *time.Location) {
+		time.Local = local
+	}(time.Local)
+	time.Local = plus2
+	tests := []struct {
+		spec string
+		loc  *time.Location
+		want string
+	}{
+		{"*/5 * * * *", nepal, "every:= 5m"},
+		{"*/10 * * * *", nepal, "can't translate"},
+		{"0 * * * *", plus2, "every:= 1h"},
+		{"45 * * * *", nepal, "every:= 1h"},
+		{"0 0 * * *", plus2, "every:= 1d"},
+		{"0 2 * * *", plus2, "can't translate"},
+		{"0 0 * * *", nepal, "aligned to midnight in the local time zone"},
+		{"0 */2 * * *", plus2, "every:= 2h"},
+		{"0 */3 * * *", plus2, "can't translate"},
+		{"0 0 * * mon", plus2, "every:= 1w"},
+		{"0 2 * * mon", plus2, "can't translate"},
+		{"0 0 * * 0", time.UTC, "can't translate"},
+		{"0 0 * * 7,1", time.UTC, "can't translate"},
+		{"0 0 */2 * *", time.UTC, "day of the month"},
+		{"0 0 * jan *", time.UTC, "day of the month"},
+		{"60 * * * *", time.UTC, "out of the range"},
+	}
+	for _, test := range tests {
+		got, err := Translate([]byte(test.spec+" x\n"), test.loc)
+		if err != nil {
+			t.Errorf("%s: %s", test.spec, err)
+			continue
+		}
+		if !strings.Contains(string(got), test.want) {
+			t.Errorf("%s in %s: expected %q in the translation, got:\n%s", test.spec, test.loc, test.want, got)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for _, s := range []string{"plain", "two words", `a "quoted" $var`, `it's $HOME`, "back\\slash'", "line\nfeed", ""} {
+		l := lexer.NewMode("x:= "+quote(s)+"\n", lexer.NoEval)
+		p, err := parser.New(l)
+		if err == nil {
+			_, err = p.Program()
+		}
+		if err != nil {
+			t.Errorf("quote(%q) = %s doesn't parse: %s", s, quote(s), err)
+			continue
+		}
+		if vars := p.Variables(); len(vars) != 1 || vars[0].Value != s {
+			t.Errorf("quote(%q) = %s is read as %+v", s, quote(s), vars)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package crontab
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the minutes in a day and in a week
+const (
+	day  = 24 * 60
+	week = 7 * day
+)
+
+// macros are the schedules the @ macros stand for, except @reboot.
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// schedule is the parsed time fields of a crontab entry.
+type schedule struct {
+	minutes, hours, days, months, weekdays []bool
+	// every day of the month and every month match
+	allDays, allMonths bool
+}
+
+// parseSchedule parses the five time fields of an entry.
+func parseSchedule(fields []string) (*schedule, error) {
+	var (
+		s   schedule
+		err error
+	)
+	if s.minutes, err = parseField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute field %q: %w", fields[0], err)
+	}
+	if s.hours, err = parseField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour field %q: %w", fields[1], err)
+	}
+	if s.days, err = parseField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month field %q: %w", fields[2], err)
+	}
+	if s.months, err = parseField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("month field %q: %w", fields[3], err)
+	}
+	// 7 is sunday too
+	if s.weekdays, err = parseField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("day of week field %q: %w", fields[4], err)
+	}
+	s.weekdays[0] = s.weekdays[0] || s.weekdays[7]
+	s.allDays, s.allMonths = all(s.days[1:]), all(s.months[1:])
+	return &s, nil
+}
+
+func all(set []bool) bool {
+	for _, ok := range set {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// parseField parses a comma separated list of values, ranges and steps, such as 1,5-10,*/15,
+// returning which of the values from 0 to max it matches.
+// names are the names of the values from min on, if they have any.
+func parseField(field string, min, max int, names []string) ([]bool, error) {
+	set := make([]bool, max+1)
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value %q", s)
+		}
+		if n < min || n > max {
+			return 0, fmt.Errorf("%d is out of the range %d-%d", n, min, max)
+		}
+		return n, nil
+	}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			step, part = n, part[:i]
+		}
+		lo, hi := min, max
+		switch i := strings.IndexByte(part, '-'); {
+		case part == "*":
+		case i >= 0:
+			var err error
+			if lo, err = value(part[:i]); err != nil {
+				return nil, err
+			}
+			if hi, err = value(part[i+1:]); err != nil {
+				return nil, err
+			}
+			if lo > hi {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			n, err := value(part)
+			if err != nil {
+				return nil, err
+			}
+			lo = n
+			// a value with a step runs to the end of the range
+			if step == 1 {
+				hi = n
+			}
+		}
+		for n := lo; n <= hi; n += step {
+			set[n] = true
+		}
+	}
+	return set, nil
+}
+
+// interval returns the interval and the phase of a schedule
+// whose runs are evenly spaced in every week: it runs at the phase-th minute of a week,
+// counted from monday 00:00, and every interval after it.
+// It returns the reason why not if the schedule isn't one.
+func (s *schedule) interval() (interval, phase int, reason string) {
+	if !s.allDays || !s.allMonths {
+		return 0, 0, "inscript can't schedule by the day of the month or the month"
+	}
+	var runs []int
+	for d := 0; d < 7; d++ {
+		// cron counts the days of the week from sunday
+		if !s.weekdays[(d+1)%7] {
+			continue
+		}
+		for h, ok := range s.hours {
+			for m, ok2 := range s.minutes {
+				if ok && ok2 {
+					runs = append(runs, d*day+h*60+m)
+				}
+			}
+		}
+	}
+	if len(runs) == 0 || week%len(runs) != 0 {
+		return 0, 0, "the runs aren't evenly spaced"
+	}
+	interval = week / len(runs)
+	for i, run := range runs {
+		if run != runs[0]+i*interval {
+			return 0, 0, "the runs aren't evenly spaced"
+		}
+	}
+	return interval, runs[0], ""
+}
+
+// aligned reports whether the ticks of every:= with the given interval fall on the runs of a schedule in loc.
+// The ticks of intervals shorter than a day are aligned to UTC, counted from a monday,
+// so they fall on the runs if the phase and the offset of loc from UTC are the same modulo the interval.
+// The ticks of a day or more are aligned to midnight in the local time zone, and weeks to mondays,
+// so they fall on the runs if the phase is a multiple of the interval and loc keeps the local time.
+// The offsets in winter and in summer are both checked.
+func aligned(interval, phase int, loc *time.Location) bool {
+	if interval >= day && phase%interval != 0 {
+		return false
+	}
+	year := time.Now().Year()
+	for _, month := range []time.Month{time.January, time.July} {
+		_, offset := time.Date(year, month, 1, 0, 0, 0, 0, loc).Zone()
+		if interval >= day {
+			if _, local := time.Date(year, month, 1, 0, 0, 0, 0, time.Local).Zone(); offset != local {
+				return false
+			}
+		} else if ((phase-offset/60)%interval+interval)%interval != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// alignment describes what the ticks of every:= with the given interval are aligned to.
+func alignment(interval int) string {
+	if interval >= day {
+		return "midnight in the local time zone"
+	}
+	return "UTC"
+}
+
+// formatInterval formats an interval in minutes as a duration.
+func formatInterval(minutes int) string {
+	switch {
+	case minutes == week:
+		return "1w"
+	case minutes%day == 0:
+		return fmt.Sprintf("%dd", minutes/day)
+	case minutes%60 == 0:
+		return fmt.Sprintf("%dh", minutes/60)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/insomnimus/inscript/printer"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// format runs the fmt subcommand with the arguments following it.
+// It exits with status 1 if any file can't be formatted.
+func format(argv []string) {
+	var list, write, diff bool
+	flags := flag.NewFlagSet("inscript fmt", flag.ContinueOnError)
+	flags.Usage = func() {}
+	flags.BoolVar(&list, "l", false, "")
+	flags.BoolVar(&write, "w", false, "")
+	flags.BoolVar(&diff, "d", false, "")
+	if err := flags.Parse(argv); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			showHelp()
+		}
+		log.Fatal(usage)
+	}
+
+	if flags.NArg() == 0 {
+		if write {
+			log.Fatal("can't use -w on the standard input")
+		}
+		if err := formatFile("<standard input>", os.Stdin, list, false, diff); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	failed := false
+	for _, path := range flags.Args() {
+		f, err := os.Open(path)
+		if err == nil {
+			err = formatFile(path, f, list, write, diff)
+			f.Close()
+		}
+		if err != nil {
+			log.Print(err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// formatFile formats the script read from r.
+// With none of list, write and diff, the result is printed.
+func formatFile(path string, r io.Reader, list, write, diff bool) error {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	out, err := printer.Format(src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	changed := !bytes.Equal(src, out)
+	if list && changed {
+		fmt.Println(path)
+	}
+	if write && changed {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, out, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	if diff && changed {
+		fmt.Print(unifiedDiff(path, string(src), string(out)))
+	}
+	if !list && !write && !diff {
+		_, err = os.Stdout.Write(out)
+	}
+	return err
+}
+
+// unifiedDiff returns the changes from a to b in unified format, with 3 lines of context.
+func unifiedDiff(path, a, b string) string {
+	const context = 3
+	x, y := splitLines(a), splitLines(b)
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			switch {
+			case x[i] == y[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	type line struct {
+		op   byte
+		text string
+		// the line numbers in a and b, counted from 0
+		i, j int
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			lines = append(lines, line{' ', x[i], i, j})
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', x[i], i, j})
+			i++
+		default:
+			lines = append(lines, line{'+', y[j], i, j})
+			j++
+		}
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s.orig\n+++ %s\n", path, path)
+	for k := 0; k < len(lines); {
+		if lines[k].op == ' ' {
+			k++
+			continue
+		}
+		// a hunk spans the changes closer than twice the context to each other
+		start := k - context
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for n := k; n < len(lines) && n-end <= 2*context; n++ {
+			if lines[n].op != ' ' {
+				end = n
+			}
+		}
+		end += context + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+		var na, nb int
+		for _, l := range lines[start:end] {
+			if l.op != '+' {
+				na++
+			}
+			if l.op != '-' {
+				nb++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(lines[start].i, na), hunkRange(lines[start].j, nb))
+		for _, l := range lines[start:end] {
+			fmt.Fprintf(&buf, "%c%s\n", l.op, l.text)
+		}
+		k = end
+	}
+	return buf.String()
+}
+
+// hunkRange formats the range of a hunk starting at the line start, counted from 0, and n lines long.
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
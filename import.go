@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/insomnimus/inscript/crontab"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// importFrom runs the import subcommand with the arguments following it.
+func importFrom(argv []string) {
+	if len(argv) == 0 || argv[0] != "crontab" {
+		if len(argv) > 0 && (argv[0] == "-h" || argv[0] == "--help") {
+			showHelp()
+		}
+		log.Fatal(usage)
+	}
+	var tz string
+	flags := flag.NewFlagSet("inscript import crontab", flag.ContinueOnError)
+	flags.Usage = func() {}
+	flags.StringVar(&tz, "tz", "", "")
+	if err := flags.Parse(argv[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			showHelp()
+		}
+		log.Fatal(usage)
+	}
+	if flags.NArg() != 1 {
+		log.Fatal(usage)
+	}
+
+	loc := time.Local
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var (
+		data []byte
+		err  error
+	)
+	if path := flags.Arg(0); path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, err := crontab.Translate(data, loc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(out)
+}
@@ -0,0 +1,229 @@
+// Package jobfile reads programs from JSON, YAML and TOML job files,
+// for scripts generated by other programs.
+//
+// A job file is either a list of jobs or a mapping with a list of jobs under the jobs key.
+// The other keys of the mapping are directives, except pools, a mapping of pool names to their limits.
+// A job is a mapping with the command, its args and any field of command blocks, such as:
+//
+//	maxparallel: 2
+//	jobs:
+//	  - name: backup
+//	    command: tar
+//	    args: [czf, backup.tgz, data]
+//	    every: 1h
+//	    stdout: [">>backup.log", "!stdout"]
+//
+// Values are taken literally: variables aren't expanded and commands aren't substituted.
+// Only the commonly used subsets of YAML and TOML are supported:
+// YAML anchors, tags, flow mappings and multiple documents and TOML dotted keys and dates are not.
+package jobfile
+
+import (
+	"fmt"
+	"github.com/insomnimus/inscript/ast"
+	"github.com/insomnimus/inscript/parser"
+	"path/filepath"
+	"strings"
+)
+
+// Format is the format of a job file.
+type Format string
+
+const (
+	JSON Format = "json"
+	YAML Format = "yaml"
+	TOML Format = "toml"
+)
+
+// ParseFormat parses the name of a format, such as json.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "json":
+		return JSON, nil
+	case "yaml", "yml":
+		return YAML, nil
+	case "toml":
+		return TOML, nil
+	default:
+		return "", fmt.Errorf("unknown job file format %q, expected json, yaml or toml", s)
+	}
+}
+
+// FormatOf returns the format of the job file at path by its extension.
+// It returns false if the extension isn't the one of a job file.
+func FormatOf(path string) (Format, bool) {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	if ext == "" {
+		return "", false
+	}
+	f, err := ParseFormat(ext)
+	return f, err == nil
+}
+
+// Parse parses a job file with p, which should be created with parser.NewStructured.
+func Parse(p *parser.Parser, data []byte, format Format) (*ast.Program, error) {
+	var (
+		root *node
+		err  error
+	)
+	switch format {
+	case JSON:
+		root, err = decodeJSON(data)
+	case YAML:
+		root, err = decodeYAML(data)
+	case TOML:
+		root, err = decodeTOML(data)
+	default:
+		return nil, fmt.Errorf("unknown job file format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return build(p, root)
+}
+
+type kind uint8
+
+const (
+	null kind = iota
+	scalar
+	list
+	mapping
+)
+
+func (k kind) String() string {
+	switch k {
+	case null:
+		return "null"
+	case scalar:
+		return "value"
+	case list:
+		return "list"
+	default:
+		return "mapping"
+	}
+}
+
+// node is a decoded value of a job file.
+type node struct {
+	kind kind
+	line int
+	// scalars
+	value string
+	// lists
+	items []*node
+	// mappings, in order
+	keys []string
+	vals []*node
+}
+
+func (n *node) set(key string, val *node) {
+	n.keys = append(n.keys, key)
+	n.vals = append(n.vals, val)
+}
+
+func build(p *parser.Parser, root *node) (*ast.Program, error) {
+	jobs := root
+	if root.kind == mapping {
+		jobs = nil
+		// the directives apply to every job, wherever they are
+		for i, key := range root.keys {
+			val := root.vals[i]
+			switch strings.ToLower(key) {
+			case "jobs":
+				if val.kind != list {
+					return nil, fmt.Errorf("line %d: jobs must be a list, not a %s", val.line, val.kind)
+				}
+				jobs = val
+			case "pools":
+				if val.kind != mapping {
+					return nil, fmt.Errorf("line %d: pools must be a mapping of pool names to limits, not a %s", val.line, val.kind)
+				}
+				for j, name := range val.keys {
+					words, err := words(name, val.vals[j])
+					if err != nil {
+						return nil, err
+					}
+					if err := p.SetDirective("pool "+name, strings.Join(words, " "), val.vals[j].line); err != nil {
+						return nil, err
+					}
+				}
+			default:
+				words, err := words(key, val)
+				if err != nil {
+					return nil, err
+				}
+				if err := p.SetDirective(key, strings.Join(words, " "), val.line); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if jobs == nil || jobs.kind != list {
+		return nil, fmt.Errorf("line %d: expected a list of jobs, or a mapping with jobs", root.line)
+	}
+
+	prog := &ast.Program{Variables: []ast.Variable{}, Commands: []*ast.Command{}}
+	for _, job := range jobs.items {
+		cmd, err := buildJob(p, job)
+		if err != nil {
+			return nil, err
+		}
+		prog.Commands = append(prog.Commands, cmd)
+	}
+	prog.Settings = p.Settings()
+	return prog, nil
+}
+
+func buildJob(p *parser.Parser, job *node) (*ast.Command, error) {
+	if job.kind != mapping {
+		return nil, fmt.Errorf("line %d: a job must be a mapping, not a %s", job.line, job.kind)
+	}
+	var (
+		command string
+		args    []string
+		fields  []parser.Field
+	)
+	for i, key := range job.keys {
+		vals, err := words(key, job.vals[i])
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(key) {
+		case "command":
+			if len(vals) != 1 || vals[0] == "" {
+				return nil, fmt.Errorf("line %d: command must be a single non-empty value", job.vals[i].line)
+			}
+			command = vals[0]
+		case "args":
+			args = vals
+		default:
+			fields = append(fields, parser.Field{Key: key, Values: vals, Line: job.vals[i].line})
+		}
+	}
+	if command == "" {
+		return nil, fmt.Errorf("line %d: the job has no command", job.line)
+	}
+	return p.Command(command, args, fields, job.line)
+}
+
+// words returns the value of key as the words of a field: a value is one word, a list of values is many.
+func words(key string, n *node) ([]string, error) {
+	switch n.kind {
+	case null:
+		return nil, nil
+	case scalar:
+		return []string{n.value}, nil
+	case list:
+		words := make([]string, len(n.items))
+		for i, item := range n.items {
+			if item.kind != scalar {
+				return nil, fmt.Errorf("line %d: %s: expected a list of values, found a %s in it", item.line, key, item.kind)
+			}
+			words[i] = item.value
+		}
+		return words, nil
+	default:
+		return nil, fmt.Errorf("line %d: %s: expected a value or a list of values, not a %s", n.line, key, n.kind)
+	}
+}
@@ -0,0 +1,161 @@
+package jobfile
+
+import (
+	"github.com/insomnimus/inscript/ast"
+	"github.com/insomnimus/inscript/parser"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	want := []ast.Command{
+		{
+			Command: "tar",
+			Args:    []string{"czf", "a b.tgz", "$HOME"},
+			Name:    "backup",
+			Every:   time.Hour,
+			Stdout:  []ast.Redirect{{Target: "backup.log", Append: true}, {Target: "!stdout"}},
+			Pool:    "net",
+		},
+		{Command: "cat", Input: "one\ntwo\n", Sync: true, Times: 2},
+	}
+	files := map[Format]string{
+		JSON: `{
+	"maxparallel": 2,
+	"pools": {"net": 1},
+	"jobs": [
+		{
+			"name": "backup", "command": "tar", "args": ["czf", "a b.tgz", "$HOME"],
+			"every": "1h", "stdout": [">>backup.log", "!stdout"], "pool": "net"
+		},
+		{"command": "cat", "input": "one\ntwo\n", "sync": true, "times": 2}
+	]
+}`,
+		YAML: `# comment
+maxparallel: 2
+pools:
+  net: 1
+jobs:
+- name: backup
+  command: tar
+  args: [czf, "a b.tgz", '$HOME']
+  every: 1h  # hourly
+  stdout:
+    - ">>backup.log"
+    - "!stdout"
+  pool: net
+- command: cat
+  input: |
+    one
+    two
+  sync: true
+  times: 2
+`,
+		TOML: `maxparallel = 2 # comment
+
+[pools]
+net = 1
+
+[[jobs]]
+name = "backup"
+command = "tar"
+args = [
+	"czf",
+	"a b.tgz",
+	'$HOME',
+]
+every = "1h"
+stdout = [">>backup.log", "!stdout"]
+pool = "net"
+
+[[jobs]]
+command = "cat"
+input = """
+one
+two
+"""
+sync = true
+times = 2
+`,
+	}
+	for format, src := range files {
+		prog, err := Parse(parser.NewStructured(), []byte(src), format)
+		if err != nil {
+			t.Errorf("%s: Parse returned error: %s", format, err)
+			continue
+		}
+		if prog.Settings.MaxParallel != 2 || prog.Settings.Pools["net"] != 1 {
+			t.Errorf("%s: unexpected settings: %+v", format, prog.Settings)
+		}
+		if len(prog.Commands) != len(want) {
+			t.Errorf("%s: expected %d commands, got %d", format, len(want), len(prog.Commands))
+			continue
+		}
+		for i, cmd := range prog.Commands {
+			if !cmd.Equal(want[i]) {
+				t.Errorf("%s: command %d mismatch:\nexpected: %#v\ngot: %#v", format, i, want[i], *cmd)
+			}
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		format  Format
+		src     string
+		wantErr string
+	}{
+		{JSON, `[{"command": "date"}, {"command": "date", "evry": "1h"}]`, `line 1: unknown field "evry" in command block, did you mean "every"?`},
+		{JSON, "{\"jobs\": [\n{\"command\": \"date\", \"every\": \"1s\"}]}", "line 2: every:= 1s: time interval can't be shorter than 30s"},
+		{JSON, `[{"args": ["x"]}]`, "line 1: the job has no command"},
+		{JSON, `{"maxparalel": 2, "jobs": []}`, `line 1: unrecognized directive: <maxparalel=2>, did you mean "maxparallel"?`},
+		{JSON, `{"jobs": [{"command": "date"}]`, "line 1: unexpected end of JSON input"},
+		{YAML, "- command: date\n  args: [[x]]\n", "line 2: nested collections aren't supported"},
+		{YAML, "- command: date\n\tsync: true\n", "line 2: tabs can't be used for indentation"},
+		{YAML, "- command: date\n    sync: true\n", "line 2: unexpected indentation"},
+		{YAML, "jobs: date\n", "line 1: jobs must be a list, not a value"},
+		{TOML, "[[jobs]]\ncommand = date\n", `line 2: invalid value "date", strings must be quoted`},
+		{TOML, "[[jobs]]\ncommand = \"date\"\ntimes = [1, [2]]\n", "line 3: times: expected a list of values, found a list in it"},
+		{TOML, "a.b = 1\n", "line 1: dotted keys aren't supported"},
+	}
+	for _, test := range tests {
+		_, err := Parse(parser.NewStructured(), []byte(test.src), test.format)
+		if err == nil || err.Error() != test.wantErr {
+			t.Errorf("%s %q: expected the error %q, got %v", test.format, test.src, test.wantErr, err)
+		}
+	}
+}
+
+func TestYAMLScalars(t *testing.T) {
+	src := `- command: sh
+  args:
+  - -c
+  - "printf '%s\n' \"$1\" é"
+  input: >
+    folded
+    text
+
+    new paragraph
+  prefix: ~
+`
+	prog, err := Parse(parser.NewStructured(), []byte(src), YAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := prog.Commands[0]
+	if want := []string{"-c", "printf '%s\n' \"$1\" é"}; strings.Join(cmd.Args, "|") != strings.Join(want, "|") {
+		t.Errorf("expected the args %q, got %q", want, cmd.Args)
+	}
+	if want := "folded text\nnew paragraph\n"; cmd.Input != want {
+		t.Errorf("expected the input %q, got %q", want, cmd.Input)
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	for path, want := range map[string]Format{"a.json": JSON, "a.YAML": YAML, "a.yml": YAML, "dir/a.toml": TOML, "a.ins": "", "a": ""} {
+		if got, ok := FormatOf(path); got != want || ok != (want != "") {
+			t.Errorf("FormatOf(%q): expected %q, got %q, %t", path, want, got, ok)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package jobfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+type jsonDecoder struct {
+	data []byte
+	dec  *json.Decoder
+}
+
+func decodeJSON(data []byte) (*node, error) {
+	d := &jsonDecoder{data: data, dec: json.NewDecoder(bytes.NewReader(data))}
+	d.dec.UseNumber()
+	n, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("line %d: unexpected data after the top-level value", d.line())
+	}
+	return n, nil
+}
+
+// line returns the line the decoder is on.
+func (d *jsonDecoder) line() int {
+	return 1 + bytes.Count(d.data[:d.dec.InputOffset()], []byte("\n"))
+}
+
+func (d *jsonDecoder) token() (json.Token, error) {
+	t, err := d.dec.Token()
+	if err == io.EOF {
+		return nil, fmt.Errorf("line %d: unexpected end of file", d.line())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", d.line(), err)
+	}
+	return t, nil
+}
+
+func (d *jsonDecoder) value() (*node, error) {
+	t, err := d.token()
+	if err != nil {
+		return nil, err
+	}
+	n := &node{line: d.line()}
+	switch t := t.(type) {
+	case json.Delim:
+		switch t {
+		case '[':
+			n.kind = list
+			for d.dec.More() {
+				item, err := d.value()
+				if err != nil {
+					return nil, err
+				}
+				n.items = append(n.items, item)
+			}
+		case '{':
+			n.kind = mapping
+			for d.dec.More() {
+				key, err := d.token()
+				if err != nil {
+					return nil, err
+				}
+				val, err := d.value()
+				if err != nil {
+					return nil, err
+				}
+				n.set(key.(string), val)
+			}
+		}
+		// the closing delimiter
+		if _, err := d.token(); err != nil {
+			return nil, err
+		}
+	case string:
+		n.kind, n.value = scalar, t
+	case json.Number:
+		n.kind, n.value = scalar, t.String()
+	case bool:
+		n.kind, n.value = scalar, strconv.FormatBool(t)
+	case nil:
+		n.kind = null
+	}
+	return n, nil
+}
@@ -0,0 +1,298 @@
+package jobfile
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tomlDecoder struct {
+	src  string
+	pos  int
+	line int
+}
+
+func decodeTOML(data []byte) (*node, error) {
+	d := &tomlDecoder{src: strings.ReplaceAll(string(data), "\r\n", "\n"), line: 1}
+	root := &node{kind: mapping, line: 1}
+	table := root
+	for {
+		d.skip(true)
+		if d.pos == len(d.src) {
+			return root, nil
+		}
+		line := d.line
+		if d.src[d.pos] == '[' {
+			array := strings.HasPrefix(d.src[d.pos:], "[[")
+			d.pos++
+			if array {
+				d.pos++
+			}
+			d.skip(false)
+			name, err := d.key()
+			if err != nil {
+				return nil, err
+			}
+			d.skip(false)
+			end := "]"
+			if array {
+				end = "]]"
+			}
+			if !strings.HasPrefix(d.src[d.pos:], end) {
+				return nil, fmt.Errorf("line %d: expected %s after the table name", d.line, end)
+			}
+			d.pos += len(end)
+			table = &node{kind: mapping, line: line}
+			existing := root.get(name)
+			switch {
+			case array && existing == nil:
+				root.set(name, &node{kind: list, line: line, items: []*node{table}})
+			case array && existing.kind == list:
+				existing.items = append(existing.items, table)
+			case existing == nil:
+				root.set(name, table)
+			default:
+				return nil, fmt.Errorf("line %d: %s is already defined", line, name)
+			}
+		} else {
+			key, err := d.key()
+			if err != nil {
+				return nil, err
+			}
+			d.skip(false)
+			if !strings.HasPrefix(d.src[d.pos:], "=") {
+				return nil, fmt.Errorf("line %d: expected '=' after %s", d.line, key)
+			}
+			d.pos++
+			d.skip(false)
+			val, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			if table.get(key) != nil {
+				return nil, fmt.Errorf("line %d: duplicate key %q", line, key)
+			}
+			table.set(key, val)
+		}
+		d.skip(false)
+		if d.pos < len(d.src) && d.src[d.pos] != '\n' {
+			return nil, fmt.Errorf("line %d: expected the end of the line", d.line)
+		}
+	}
+}
+
+// get returns the value of key in a mapping, or nil if it has none.
+func (n *node) get(key string) *node {
+	for i, k := range n.keys {
+		if k == key {
+			return n.vals[i]
+		}
+	}
+	return nil
+}
+
+// skip skips spaces and comments, and line breaks too if newlines is true.
+func (d *tomlDecoder) skip(newlines bool) {
+	for d.pos < len(d.src) {
+		switch c := d.src[d.pos]; {
+		case c == ' ' || c == '\t':
+			d.pos++
+		case c == '\n' && newlines:
+			d.pos++
+			d.line++
+		case c == '#':
+			for d.pos < len(d.src) && d.src[d.pos] != '\n' {
+				d.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isBare(c byte) bool {
+	return c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func (d *tomlDecoder) key() (string, error) {
+	var key string
+	if d.pos < len(d.src) && (d.src[d.pos] == '"' || d.src[d.pos] == '\'') {
+		s, n, err := quoted(d.src[d.pos:], d.line)
+		if err != nil {
+			return "", err
+		}
+		if strings.Contains(d.src[d.pos:d.pos+n], "\n") {
+			return "", fmt.Errorf("line %d: keys can't span lines", d.line)
+		}
+		key = s
+		d.pos += n
+	} else {
+		start := d.pos
+		for d.pos < len(d.src) && isBare(d.src[d.pos]) {
+			d.pos++
+		}
+		if start == d.pos {
+			return "", fmt.Errorf("line %d: expected a key", d.line)
+		}
+		key = d.src[start:d.pos]
+	}
+	if strings.HasPrefix(strings.TrimLeft(d.src[d.pos:], " \t"), ".") {
+		return "", fmt.Errorf("line %d: dotted keys aren't supported", d.line)
+	}
+	return key, nil
+}
+
+func (d *tomlDecoder) value() (*node, error) {
+	n := &node{kind: scalar, line: d.line}
+	rest := d.src[d.pos:]
+	switch {
+	case rest == "":
+		return nil, fmt.Errorf("line %d: expected a value", d.line)
+	case strings.HasPrefix(rest, `"""`), strings.HasPrefix(rest, "'''"):
+		return d.multiline(rest[:3])
+	case rest[0] == '"' || rest[0] == '\'':
+		s, i, err := quoted(rest, d.line)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(rest[:i], "\n") {
+			return nil, fmt.Errorf("line %d: unterminated string", d.line)
+		}
+		n.value = s
+		d.pos += i
+	case rest[0] == '[':
+		n.kind = list
+		d.pos++
+		for {
+			d.skip(true)
+			if d.pos < len(d.src) && d.src[d.pos] == ']' {
+				d.pos++
+				break
+			}
+			item, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, item)
+			d.skip(true)
+			if d.pos < len(d.src) && d.src[d.pos] == ',' {
+				d.pos++
+				continue
+			}
+			if d.pos < len(d.src) && d.src[d.pos] == ']' {
+				d.pos++
+				break
+			}
+			return nil, fmt.Errorf("line %d: expected ',' or ']' in array", d.line)
+		}
+	case rest[0] == '{':
+		n.kind = mapping
+		d.pos++
+		d.skip(false)
+		if d.pos < len(d.src) && d.src[d.pos] == '}' {
+			d.pos++
+			break
+		}
+		for {
+			d.skip(false)
+			key, err := d.key()
+			if err != nil {
+				return nil, err
+			}
+			d.skip(false)
+			if !strings.HasPrefix(d.src[d.pos:], "=") {
+				return nil, fmt.Errorf("line %d: expected '=' after %s", d.line, key)
+			}
+			d.pos++
+			d.skip(false)
+			val, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			n.set(key, val)
+			d.skip(false)
+			if d.pos < len(d.src) && d.src[d.pos] == ',' {
+				d.pos++
+				continue
+			}
+			if d.pos < len(d.src) && d.src[d.pos] == '}' {
+				d.pos++
+				break
+			}
+			return nil, fmt.Errorf("line %d: expected ',' or '}' in inline table", d.line)
+		}
+	default:
+		// booleans and numbers
+		i := strings.IndexAny(rest, ",]} \t\n#")
+		if i < 0 {
+			i = len(rest)
+		}
+		s := rest[:i]
+		switch {
+		case s == "":
+			return nil, fmt.Errorf("line %d: expected a value", d.line)
+		case s == "true" || s == "false":
+		case strings.IndexAny(s[:1], "0123456789+-") == 0 || s == "inf" || s == "nan":
+			s = strings.ReplaceAll(s, "_", "")
+		default:
+			return nil, fmt.Errorf("line %d: invalid value %q, strings must be quoted", d.line, s)
+		}
+		n.value = s
+		d.pos += i
+	}
+	return n, nil
+}
+
+// multiline decodes a multi-line string delimited by three double or single quotes.
+func (d *tomlDecoder) multiline(delim string) (*node, error) {
+	n := &node{kind: scalar, line: d.line}
+	d.pos += 3
+	// a line break right after the delimiter isn't part of the string
+	if strings.HasPrefix(d.src[d.pos:], "\n") {
+		d.pos++
+		d.line++
+	}
+	var b strings.Builder
+	for {
+		if d.pos == len(d.src) {
+			return nil, fmt.Errorf("line %d: unterminated string", n.line)
+		}
+		if strings.HasPrefix(d.src[d.pos:], delim) {
+			// up to two quotes may come right before the delimiter
+			for strings.HasPrefix(d.src[d.pos+1:], delim) {
+				b.WriteByte(delim[0])
+				d.pos++
+			}
+			d.pos += 3
+			n.value = b.String()
+			return n, nil
+		}
+		c := d.src[d.pos]
+		switch {
+		case c == '\\' && delim == `"""`:
+			rest := d.src[d.pos+1:]
+			if trimmed := strings.TrimLeft(rest, " \t"); strings.HasPrefix(trimmed, "\n") {
+				// a line ending backslash trims the whitespace after it
+				d.pos++
+				for d.pos < len(d.src) && strings.IndexByte(" \t\n", d.src[d.pos]) >= 0 {
+					if d.src[d.pos] == '\n' {
+						d.line++
+					}
+					d.pos++
+				}
+				continue
+			}
+			s, i, err := unescape(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", d.line, err)
+			}
+			b.WriteString(s)
+			d.pos += i + 1
+		default:
+			if c == '\n' {
+				d.line++
+			}
+			b.WriteByte(c)
+			d.pos++
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package jobfile
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type yamlLine struct {
+	// the number of the line, counted from 1
+	n      int
+	indent int
+	// the text after the indentation, without trailing space
+	text string
+	// blank or a comment
+	blank bool
+}
+
+type yamlDecoder struct {
+	raw   []string
+	lines []yamlLine
+	// the index of the next line
+	i int
+}
+
+func decodeYAML(data []byte) (*node, error) {
+	d := &yamlDecoder{raw: strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")}
+	for i, raw := range d.raw {
+		text := strings.TrimRight(raw, " \t")
+		trimmed := strings.TrimLeft(text, " ")
+		l := yamlLine{n: i + 1, indent: len(text) - len(trimmed), text: trimmed}
+		l.blank = trimmed == "" || trimmed[0] == '#' || trimmed == "---" && l.indent == 0
+		d.lines = append(d.lines, l)
+	}
+	l := d.peek()
+	if l == nil {
+		return &node{kind: null, line: 1}, nil
+	}
+	root, err := d.block(l.indent)
+	if err != nil {
+		return nil, err
+	}
+	if l := d.peek(); l != nil {
+		return nil, fmt.Errorf("line %d: unexpected indentation", l.n)
+	}
+	return root, nil
+}
+
+// peek returns the next line that isn't blank, or nil at the end of the file.
+func (d *yamlDecoder) peek() *yamlLine {
+	for d.i < len(d.lines) && d.lines[d.i].blank {
+		d.i++
+	}
+	if d.i == len(d.lines) {
+		return nil
+	}
+	return &d.lines[d.i]
+}
+
+// block decodes the block starting on the next line, which is indented by indent.
+func (d *yamlDecoder) block(indent int) (*node, error) {
+	l := d.peek()
+	if err := checkTabs(l); err != nil {
+		return nil, err
+	}
+	if isItem(l.text) {
+		return d.sequence(indent)
+	}
+	if _, _, ok, err := splitKey(l.text, l.n); err != nil {
+		return nil, err
+	} else if ok {
+		return d.mapping(indent)
+	}
+	d.i++
+	return yamlScalar(l.text, l.n)
+}
+
+// checkTabs returns an error if l is indented with tabs, which YAML doesn't allow.
+// Only the lines outside block scalars are checked, tabs are fine in them.
+func checkTabs(l *yamlLine) error {
+	if strings.HasPrefix(l.text, "\t") {
+		return fmt.Errorf("line %d: tabs can't be used for indentation", l.n)
+	}
+	return nil
+}
+
+func isItem(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "- ")
+}
+
+func (d *yamlDecoder) sequence(indent int) (*node, error) {
+	n := &node{kind: list, line: d.peek().n}
+	for l := d.peek(); l != nil && l.indent >= indent; l = d.peek() {
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.n)
+		}
+		if err := checkTabs(l); err != nil {
+			return nil, err
+		}
+		if !isItem(l.text) {
+			break
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if rest == "" || rest[0] == '#' {
+			d.i++
+			item := &node{kind: null, line: l.n}
+			if next := d.peek(); next != nil && next.indent > indent {
+				var err error
+				if item, err = d.block(next.indent); err != nil {
+					return nil, err
+				}
+			}
+			n.items = append(n.items, item)
+			continue
+		}
+		// the item starts after the dash, as if it were on a line of its own
+		l.indent += len(l.text) - len(rest)
+		l.text = rest
+		item, err := d.block(l.indent)
+		if err != nil {
+			return nil, err
+		}
+		n.items = append(n.items, item)
+	}
+	return n, nil
+}
+
+func (d *yamlDecoder) mapping(indent int) (*node, error) {
+	n := &node{kind: mapping, line: d.peek().n}
+	for l := d.peek(); l != nil && l.indent >= indent; l = d.peek() {
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.n)
+		}
+		if err := checkTabs(l); err != nil {
+			return nil, err
+		}
+		key, rest, ok, err := splitKey(l.text, l.n)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected a key: value pair", l.n)
+		}
+		for _, k := range n.keys {
+			if k == key {
+				return nil, fmt.Errorf("line %d: duplicate key %q", l.n, key)
+			}
+		}
+		d.i++
+		var val *node
+		switch {
+		case rest == "" || rest[0] == '#':
+			val = &node{kind: null, line: l.n}
+			// a sequence may be indented as much as its key
+			if next := d.peek(); next != nil && (next.indent > indent || next.indent == indent && isItem(next.text)) {
+				val, err = d.block(next.indent)
+			}
+		case rest[0] == '|' || rest[0] == '>':
+			val, err = d.blockScalar(indent, rest, l.n)
+		default:
+			val, err = yamlScalar(rest, l.n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.set(key, val)
+	}
+	return n, nil
+}
+
+// splitKey splits a key: value line.
+// It returns false if s isn't one.
+func splitKey(s string, line int) (key, rest string, ok bool, err error) {
+	if s == "" || s[0] == '[' || s[0] == '{' || isItem(s) {
+		return "", "", false, nil
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		key, n, err := quoted(s, line)
+		if err != nil {
+			return "", "", false, err
+		}
+		rest = s[n:]
+		if rest != ":" && !strings.HasPrefix(rest, ": ") {
+			return "", "", false, nil
+		}
+		return key, strings.TrimSpace(rest[1:]), true, nil
+	}
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '#' && i > 0 && s[i-1] == ' ':
+			return "", "", false, nil
+		case s[i] == ':' && (i+1 == len(s) || s[i+1] == ' '):
+			return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]), true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+// yamlScalar decodes a value on a single line: a quoted or plain scalar, or a flow sequence.
+func yamlScalar(s string, line int) (*node, error) {
+	n := &node{kind: scalar, line: line}
+	var rest string
+	switch s[0] {
+	case '"', '\'':
+		val, i, err := quoted(s, line)
+		if err != nil {
+			return nil, err
+		}
+		n.value, rest = val, s[i:]
+	case '[':
+		n.kind = list
+		i := 1
+		for {
+			for i < len(s) && s[i] == ' ' {
+				i++
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("line %d: unterminated flow sequence, sequences spanning lines aren't supported", line)
+			}
+			// a trailing comma is allowed
+			if s[i] == ']' {
+				i++
+				break
+			}
+			item := &node{kind: scalar, line: line}
+			switch s[i] {
+			case '"', '\'':
+				val, j, err := quoted(s[i:], line)
+				if err != nil {
+					return nil, err
+				}
+				item.value = val
+				i += j
+			case '[', '{':
+				return nil, fmt.Errorf("line %d: nested collections aren't supported", line)
+			default:
+				j := strings.IndexAny(s[i:], ",]")
+				if j < 0 {
+					return nil, fmt.Errorf("line %d: unterminated flow sequence, sequences spanning lines aren't supported", line)
+				}
+				item.value = strings.TrimSpace(s[i : i+j])
+				i += j
+			}
+			n.items = append(n.items, item)
+			for i < len(s) && s[i] == ' ' {
+				i++
+			}
+			if i < len(s) && s[i] == ',' {
+				i++
+				continue
+			}
+			if i < len(s) && s[i] == ']' {
+				i++
+				break
+			}
+			return nil, fmt.Errorf("line %d: expected ',' or ']' in flow sequence", line)
+		}
+		rest = s[i:]
+	case '{':
+		return nil, fmt.Errorf("line %d: flow mappings aren't supported", line)
+	default:
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = s[:i]
+		}
+		s = strings.TrimSpace(s)
+		if s == "~" || s == "null" {
+			n.kind = null
+		}
+		n.value = s
+		return n, nil
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+		return nil, fmt.Errorf("line %d: unexpected %q after value", line, rest)
+	}
+	return n, nil
+}
+
+// quoted decodes the quoted string at the start of s and returns it along with the number of bytes it takes.
+func quoted(s string, line int) (string, int, error) {
+	var b strings.Builder
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == q:
+			return b.String(), i + 1, nil
+		case c == '\\' && q == '"':
+			r, n, err := unescape(s[i+1:])
+			if err != nil {
+				return "", 0, fmt.Errorf("line %d: %w", line, err)
+			}
+			b.WriteString(r)
+			i += n
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("line %d: unterminated string, strings spanning lines aren't supported", line)
+}
+
+// unescape decodes the escape sequence at the start of s, after its backslash,
+// and returns it along with the number of bytes it takes.
+func unescape(s string) (string, int, error) {
+	if s == "" {
+		return "", 0, fmt.Errorf("unterminated escape sequence")
+	}
+	switch s[0] {
+	case 'b':
+		return "\b", 1, nil
+	case 't':
+		return "\t", 1, nil
+	case 'n':
+		return "\n", 1, nil
+	case 'f':
+		return "\f", 1, nil
+	case 'r':
+		return "\r", 1, nil
+	case 'e':
+		return "\x1b", 1, nil
+	case '0':
+		return "\x00", 1, nil
+	case '"', '\\', '/', ' ':
+		return s[:1], 1, nil
+	case 'x', 'u', 'U':
+		n := map[byte]int{'x': 2, 'u': 4, 'U': 8}[s[0]]
+		if len(s) <= n {
+			return "", 0, fmt.Errorf("invalid escape sequence \\%s", s)
+		}
+		r, err := strconv.ParseUint(s[1:n+1], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return "", 0, fmt.Errorf("invalid escape sequence \\%s", s[:n+1])
+		}
+		return string(rune(r)), n + 1, nil
+	default:
+		return "", 0, fmt.Errorf("invalid escape sequence \\%c", s[0])
+	}
+}
+
+// blockScalar decodes a literal (|) or folded (>) block scalar,
+// whose lines are indented more than its key.
+func (d *yamlDecoder) blockScalar(indent int, header string, line int) (*node, error) {
+	if i := strings.Index(header, " #"); i >= 0 {
+		header = header[:i]
+	}
+	folded := header[0] == '>'
+	chomp := strings.TrimSpace(header[1:])
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		return nil, fmt.Errorf("line %d: unsupported block scalar header %q", line, header)
+	}
+	var lines []string
+	blockIndent := -1
+	for ; d.i < len(d.raw); d.i++ {
+		raw := strings.TrimRight(d.raw[d.i], " \t\r")
+		if raw == "" {
+			lines = append(lines, "")
+			continue
+		}
+		n := len(raw) - len(strings.TrimLeft(raw, " "))
+		if n <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = n
+		}
+		if n < blockIndent {
+			return nil, fmt.Errorf("line %d: the lines of a block scalar must be indented as much as its first one", d.i+1)
+		}
+		lines = append(lines, raw[blockIndent:])
+	}
+	// the trailing blank lines
+	content := len(lines)
+	for content > 0 && lines[content-1] == "" {
+		content--
+	}
+	var b strings.Builder
+	for i, l := range lines[:content] {
+		switch {
+		case i == 0:
+		case !folded || l == "":
+			b.WriteByte('\n')
+		case lines[i-1] == "":
+			// the line break was written for the blank line
+		case l[0] == ' ' || lines[i-1][0] == ' ':
+			// more indented lines aren't folded
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(' ')
+		}
+		b.WriteString(l)
+	}
+	switch {
+	case content == 0:
+	case chomp == "-":
+	case chomp == "+":
+		b.WriteString(strings.Repeat("\n", len(lines)-content+1))
+	default:
+		b.WriteByte('\n')
+	}
+	return &node{kind: scalar, line: line, value: b.String()}, nil
+}
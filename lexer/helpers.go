@@ -3,6 +3,7 @@ package lexer
 import (
 	"fmt"
 	"github.com/insomnimus/inscript/token"
+	"strings"
 	"unicode"
 )
 
@@ -74,3 +75,28 @@ func (l *Lexer) skipSpace() {
 		l.read()
 	}
 }
+
+// dedent removes the indentation common to the non-blank lines, and blanks the blank ones.
+func dedent(lines []string) {
+	prefix, found := "", false
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeftFunc(line, unicode.IsSpace))]
+		if !found {
+			prefix, found = indent, true
+			continue
+		}
+		for !strings.HasPrefix(indent, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			lines[i] = ""
+		} else {
+			lines[i] = line[len(prefix):]
+		}
+	}
+}
@@ -11,23 +11,76 @@ import (
 	"unicode"
 )
 
+// Mode changes how a Lexer reads its input.
+type Mode uint8
+
+const (
+	// NoEval leaves command substitutions such as $(date) as they are instead of running them.
+	NoEval Mode = 1 << iota
+	// Raw implies NoEval, also leaves variables unexpanded
+	// and sets the Raw field of tokens to their source text.
+	Raw
+)
+
 type Lexer struct {
 	text         []rune
 	ch           rune
 	pos, readpos int
 	line         int
+	mode         Mode
+	// the environment variables expanded so far
+	refs map[string]bool
+	// the type of the last token read, and whether it's inside a command block
+	prev    token.TokenType
+	inBlock bool
 }
 
 func New(s string) *Lexer {
+	return NewMode(s, 0)
+}
+
+// NewMode returns a Lexer reading s in the given mode.
+func NewMode(s string, mode Mode) *Lexer {
 	s = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(s)
 	l := &Lexer{
 		text: []rune(s),
+		mode: mode,
 	}
 	l.read()
 	return l
 }
 
 func (l *Lexer) Next() (token.Token, error) {
+	t, err := l.nextToken()
+	switch t.Type {
+	case token.LBrace:
+		l.inBlock = true
+	case token.RBrace:
+		l.inBlock = false
+	}
+	l.prev = t.Type
+	return t, err
+}
+
+// nextToken reads the next token, setting its Raw field in Raw mode.
+func (l *Lexer) nextToken() (token.Token, error) {
+	if l.mode&Raw == 0 {
+		return l.next()
+	}
+	l.skipSpace()
+	start := l.pos
+	t, err := l.next()
+	if start < len(l.text) {
+		end := l.pos
+		if end > len(l.text) {
+			end = len(l.text)
+		}
+		t.Raw = string(l.text[start:end])
+	}
+	return t, err
+}
+
+func (l *Lexer) next() (token.Token, error) {
 	ln := l.line
 	var t token.Token
 	l.skipSpace()
@@ -40,8 +93,7 @@ func (l *Lexer) Next() (token.Token, error) {
 			}
 			t = l.newToken(token.String, s, ln)
 		} else {
-			s := l.readStringBare()
-			return l.newToken(token.String, s, ln), nil
+			return l.bareToken(ln)
 		}
 	case '\n':
 		t = l.newToken(token.LF, "\n")
@@ -52,10 +104,7 @@ func (l *Lexer) Next() (token.Token, error) {
 			l.read()
 			t = l.newToken(token.Assign, ":=")
 		} else {
-			return l.newToken(
-				token.String,
-				l.readStringBare(),
-				ln), nil
+			return l.bareToken(ln)
 		}
 	case '"':
 		s, err := l.readString()
@@ -71,15 +120,27 @@ func (l *Lexer) Next() (token.Token, error) {
 		t = l.newToken(token.String, s, ln)
 	case '#':
 		return l.readComment(), nil
+	case '<':
+		// only the value of a field can be a here-document, elsewhere it's an argument as in cat <<EOF
+		if l.peek() == '<' && l.inBlock && l.prev == token.Assign {
+			s, err := l.readHeredoc()
+			if err != nil {
+				return t, err
+			}
+			return l.newToken(token.Heredoc, s, ln), nil
+		}
+		return l.bareToken(ln)
 	case '@':
 		t = l.newToken(token.At, "@")
 	case '{':
+		if l.peek() == '{' && l.actionEnd() >= 0 {
+			return l.bareToken(ln)
+		}
 		t = l.newToken(token.LBrace, "{")
 	case '}':
 		t = l.newToken(token.RBrace, "}")
 	default:
-		s := l.readStringBare()
-		return l.newToken(token.String, s, ln), nil
+		return l.bareToken(ln)
 	}
 	l.read()
 	return t, nil
@@ -160,7 +221,7 @@ LOOP:
 		l.read()
 	}
 	return strings.ReplaceAll(
-		os.ExpandEnv(buff.String()), string(unicode.ReplacementChar), "$"), nil
+		l.expand(buff.String()), string(unicode.ReplacementChar), "$"), nil
 }
 
 func (l *Lexer) readStringLiteral(ch rune) (string, error) {
@@ -199,6 +260,82 @@ LOOP:
 	return buff.String(), nil
 }
 
+// readHeredoc reads a here-document: <<DELIM, then every line up to one that is just DELIM.
+// With <<-DELIM, the closing line may be indented and the common indentation of the lines is removed.
+// Environment variables are expanded unless the delimiter is quoted, as in <<'DELIM'.
+// It stops on the line feed after the closing line.
+func (l *Lexer) readHeredoc() (string, error) {
+	// sanity check
+	if l.ch != '<' || l.peek() != '<' {
+		panic(fmt.Sprintf("line %d: l.readHeredoc called on %q, expected '<<' instead", l.line, l.ch))
+	}
+	startLn := l.line
+	l.read()
+	l.read()
+	strip := l.ch == '-'
+	if strip {
+		l.read()
+	}
+	expand := true
+	var delim strings.Builder
+	switch l.ch {
+	case '\'', '"':
+		quote := l.ch
+		expand = false
+		l.read()
+		for l.ch != quote {
+			if l.ch == '\n' || l.ch == 0 {
+				return "", l.err(startLn, "here-document delimiter not terminated with \"%c\"", quote)
+			}
+			delim.WriteRune(l.ch)
+			l.read()
+		}
+		l.read()
+	default:
+		for !unicode.IsSpace(l.ch) && l.ch != 0 {
+			delim.WriteRune(l.ch)
+			l.read()
+		}
+	}
+	end := delim.String()
+	if end == "" {
+		return "", l.err(startLn, "missing here-document delimiter")
+	}
+	l.skipSpace()
+	if l.ch != '\n' {
+		return "", l.err(startLn, "unexpected %q after here-document delimiter", l.ch)
+	}
+
+	var lines []string
+	for {
+		l.read()
+		var buff strings.Builder
+		for l.ch != '\n' && l.ch != 0 {
+			buff.WriteRune(l.ch)
+			l.read()
+		}
+		line := buff.String()
+		if line == end || (strip && strings.TrimSpace(line) == end) {
+			break
+		}
+		if l.ch == 0 {
+			return "", l.err(startLn, "here-document not terminated with %q", end)
+		}
+		lines = append(lines, line)
+	}
+	if strip {
+		dedent(lines)
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	s := strings.Join(lines, "\n") + "\n"
+	if expand {
+		s = l.expand(s)
+	}
+	return s, nil
+}
+
 func (l *Lexer) readHex(buff *strings.Builder) error {
 	// sanity check
 	if l.ch != 'x' {
@@ -320,7 +457,16 @@ func (l *Lexer) readComment() token.Token {
 		ln)
 }
 
-func (l *Lexer) readStringBare() string {
+// bareToken reads an unquoted string starting on line ln.
+func (l *Lexer) bareToken(ln int) (token.Token, error) {
+	s, err := l.readStringBare()
+	if err != nil {
+		return token.Token{}, err
+	}
+	return l.newToken(token.String, s, ln), nil
+}
+
+func (l *Lexer) readStringBare() (string, error) {
 	// sanity check
 	if unicode.IsSpace(l.ch) {
 		panic(fmt.Sprintf("line %d: l.readStringBare called on a space char (%d)", l.line, l.ch))
@@ -332,7 +478,9 @@ LOOP:
 		case '\\':
 			switch l.peek() {
 			case 0:
-				break LOOP
+				// consumed so that the next call doesn't stop on it again
+				l.read()
+				return "", l.err(l.line, "unterminated escape sequence at the end of the input")
 			case '{', '}':
 				l.read()
 				buff.WriteRune(l.ch)
@@ -343,7 +491,16 @@ LOOP:
 					buff.WriteRune(l.ch)
 				}
 			}
-		case 0, '\n', '{', '}':
+		case '{':
+			if l.peek() != '{' {
+				break LOOP
+			}
+			// a template action, such as {{.Time "2006-01-02"}}, is kept as is
+			if !l.readAction(&buff) {
+				break LOOP
+			}
+			continue LOOP
+		case 0, '\n', '}':
 			break LOOP
 		case ':':
 			if l.peek() == '=' {
@@ -358,7 +515,52 @@ LOOP:
 		}
 		l.read()
 	}
-	return os.ExpandEnv(buff.String())
+	return l.expand(buff.String()), nil
+}
+
+// expand replaces the $var and ${var} references in s with the values of the environment variables,
+// noting the variables referenced.
+func (l *Lexer) expand(s string) string {
+	if l.mode&Raw != 0 {
+		return s
+	}
+	return os.Expand(s, func(name string) string {
+		if l.refs == nil {
+			l.refs = make(map[string]bool)
+		}
+		l.refs[name] = true
+		return os.Getenv(name)
+	})
+}
+
+// Referenced reports whether $name or ${name} has been expanded in the text read so far.
+func (l *Lexer) Referenced(name string) bool {
+	return l.refs[name]
+}
+
+// actionEnd returns the position of the "}}" closing the template action starting at the current "{{",
+// or -1 if it isn't closed on the same line.
+func (l *Lexer) actionEnd() int {
+	for i := l.pos + 2; i+1 < len(l.text) && l.text[i] != '\n'; i++ {
+		if l.text[i] == '}' && l.text[i+1] == '}' {
+			return i
+		}
+	}
+	return -1
+}
+
+// readAction reads a template action, from "{{" up to and including "}}", into buff.
+// It reports false if the action isn't closed on the same line.
+func (l *Lexer) readAction(buff *strings.Builder) bool {
+	end := l.actionEnd()
+	if end < 0 {
+		return false
+	}
+	for l.pos <= end+1 {
+		buff.WriteRune(l.ch)
+		l.read()
+	}
+	return true
 }
 
 func (l *Lexer) readExpression() (string, error) {
@@ -370,12 +572,19 @@ func (l *Lexer) readExpression() (string, error) {
 	if l.ch != '(' {
 		panic(fmt.Sprintf("internal error: line %d: l.readExpression called on '$%c', expected '$(' instead", l.line, l.ch))
 	}
+	startLn := l.line
 	l.read()
 	var buff strings.Builder
 	for l.ch != ')' && l.ch != 0 {
 		buff.WriteRune(l.ch)
 		l.read()
 	}
+	if l.ch == 0 {
+		return "", l.err(startLn, "command substitution not terminated with ')'")
+	}
+	if l.mode&(NoEval|Raw) != 0 {
+		return "$(" + buff.String() + ")", nil
+	}
 	lx := New(buff.String())
 	var args []string
 	for t, err := lx.Next(); t.Type != token.EOF; t, err = lx.Next() {
@@ -3,6 +3,7 @@ package lexer
 import (
 	"github.com/insomnimus/inscript/token"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -101,3 +102,174 @@ line`
 		}
 	}
 }
+
+func TestReadHeredoc(t *testing.T) {
+	os.Setenv("test_var", "testvar")
+	items := []struct {
+		in, out string
+	}{
+		{"<<EOF\nhello\n$test_var\nEOF\n", "hello\ntestvar\n"},
+		{"<<'EOF'\nselect $1;\nEOF", "select $1;\n"},
+		{"<<\"END\" \n{ }\nEOF\nEND\n", "{ }\nEOF\n"},
+		{"<<-EOF\n\t\tkey = 1\n\n\t\t\tnested\n\tEOF\n", "key = 1\n\n\tnested\n"},
+		{"<<EOF\nEOF\n", ""},
+	}
+	// field returns a lexer that has read up to the := of a field whose value is s
+	field := func(s string) *Lexer {
+		l := New("@ cat {\n\tstdin:= " + s)
+		for tok, _ := l.Next(); tok.Type != token.Assign; tok, _ = l.Next() {
+		}
+		return l
+	}
+	for _, s := range items {
+		l := field(s.in)
+		out, err := l.Next()
+		if err != nil {
+			t.Errorf("error parsing (%q): %s", s.in, err)
+			continue
+		}
+		if out.Type != token.Heredoc {
+			t.Errorf("expected type (%q) to be heredoc, got %s instead.", s.in, out.Type)
+		}
+		if out.Literal != s.out {
+			t.Errorf("here-document parsed incorrectly:\ninput: %q\nexpected %q, got %q", s.in, s.out, out.Literal)
+		}
+		if next, _ := l.Next(); next.Type != token.LF && next.Type != token.EOF {
+			t.Errorf("expected the here-document (%q) to be followed by a line feed, got %s", s.in, next.Type)
+		}
+	}
+
+	for _, in := range []string{"<<\n", "<<EOF\nno end\n", "<<EOF trailing\nEOF\n", "<<'EOF\nEOF\n"} {
+		if _, err := field(in).Next(); err == nil {
+			t.Errorf("expected an error for %q", in)
+		}
+	}
+
+	// outside of fields, << is an argument
+	l := New("cat <<EOF\n@ cat <<EOF {\n}\n")
+	var got []token.Token
+	for tok, err := l.Next(); tok.Type != token.EOF; tok, err = l.Next() {
+		if err != nil {
+			t.Fatalf("l.Next returned error: %s", err)
+		}
+		if tok.Type != token.LF {
+			got = append(got, tok)
+		}
+	}
+	want := []token.TokenType{token.String, token.String, token.At, token.String, token.String, token.LBrace, token.RBrace}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d tokens, got %+v", len(want), got)
+	}
+	for i, tok := range got {
+		if tok.Type != want[i] {
+			t.Errorf("expected token %d to be %s, got %+v", i, want[i], tok)
+		}
+	}
+	if got[1].Literal != "<<EOF" || got[4].Literal != "<<EOF" {
+		t.Errorf("expected <<EOF to be read as a string, got %+v", got)
+	}
+}
+
+func TestReadAction(t *testing.T) {
+	items := []struct {
+		in   string
+		want []string
+	}{
+		{`logs/{{.Name}}-{{.Time "20060102T150405"}}.log`, []string{`logs/{{.Name}}-{{.Time "20060102T150405"}}.log`}},
+		{"{{.Iter}}.txt {", []string{"{{.Iter}}.txt", "{"}},
+		{"a{b", []string{"a", "{", "b"}},
+		{"a{{b\n", []string{"a", "{", "{", "b"}},
+	}
+	for _, s := range items {
+		l := New(s.in)
+		var got []string
+		for tk, err := l.Next(); tk.Type != token.EOF && tk.Type != token.LF; tk, err = l.Next() {
+			if err != nil {
+				t.Fatalf("error lexing %q: %s", s.in, err)
+			}
+			got = append(got, tk.Literal)
+		}
+		if len(got) != len(s.want) {
+			t.Errorf("%q: expected %q, got %q", s.in, s.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != s.want[i] {
+				t.Errorf("%q: expected %q, got %q", s.in, s.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestNoEval(t *testing.T) {
+	items := []struct {
+		in, out string
+	}{
+		{"$(rm -rf /tmp/x)", "$(rm -rf /tmp/x)"},
+		{`"today is $(date +%F)"`, "today is $(date +%F)"},
+	}
+	for _, s := range items {
+		out, err := NewMode(s.in, NoEval).Next()
+		if err != nil {
+			t.Errorf("error parsing (%s): %s", s.in, err)
+		}
+		if out.Literal != s.out {
+			t.Errorf("expected (%s) to be left unevaluated, got (%s)", s.in, out.Literal)
+		}
+	}
+}
+
+func TestReferenced(t *testing.T) {
+	l := New(`echo $HOME "${INSCRIPT_TEST_VAR}" '$NOT_EXPANDED'`)
+	for tok, err := l.Next(); tok.Type != token.EOF; tok, err = l.Next() {
+		if err != nil {
+			t.Fatalf("l.Next returned error: %s", err)
+		}
+	}
+	for name, want := range map[string]bool{
+		"HOME":              true,
+		"INSCRIPT_TEST_VAR": true,
+		"NOT_EXPANDED":      false,
+	} {
+		if got := l.Referenced(name); got != want {
+			t.Errorf("expected Referenced(%q) to be %t", name, want)
+		}
+	}
+}
+
+func TestRaw(t *testing.T) {
+	l := NewMode(`echo  'a b' "$HOME" $(date) # done`, Raw)
+	var raws, literals []string
+	for tok, err := l.Next(); tok.Type != token.EOF; tok, err = l.Next() {
+		if err != nil {
+			t.Fatalf("l.Next returned error: %s", err)
+		}
+		raws = append(raws, tok.Raw)
+		literals = append(literals, tok.Literal)
+	}
+	wantRaw := []string{"echo", "'a b'", `"$HOME"`, "$(date)", "# done"}
+	wantLit := []string{"echo", "a b", "$HOME", "$(date)", "done"}
+	if strings.Join(raws, "|") != strings.Join(wantRaw, "|") {
+		t.Errorf("expected the source texts %q, got %q", wantRaw, raws)
+	}
+	if strings.Join(literals, "|") != strings.Join(wantLit, "|") {
+		t.Errorf("expected the literals %q, got %q", wantLit, literals)
+	}
+}
+
+func TestTrailingBackslash(t *testing.T) {
+	for _, in := range []string{`\`, `echo \`, "echo hi\n\\"} {
+		l := New(in)
+		var err error
+		for i := 0; i < 10 && err == nil; i++ {
+			var tok token.Token
+			if tok, err = l.Next(); tok.Type == token.EOF {
+				break
+			}
+		}
+		if err == nil || !strings.Contains(err.Error(), "unterminated escape") {
+			t.Errorf("expected an unterminated escape error for %q, got %v", in, err)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package lsp
+
+import (
+	"fmt"
+	"github.com/insomnimus/inscript/lexer"
+	"github.com/insomnimus/inscript/parser"
+	"github.com/insomnimus/inscript/syntax"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// diagnose returns the error the lexer or parser finds in text, if any.
+// Command substitutions aren't run.
+func diagnose(text string) []diagnostic {
+	err := parse(text)
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	line := 0
+	if _, err := fmt.Sscanf(msg, "line %d:", &line); err == nil {
+		msg = strings.TrimSpace(msg[strings.IndexByte(msg, ':')+1:])
+	}
+	return []diagnostic{{
+		Range:    lineRange(text, line),
+		Severity: severityError,
+		Source:   "inscript",
+		Message:  msg,
+	}}
+}
+
+func parse(text string) error {
+	// assignments set environment variables, which mustn't leak into other documents
+	defer parser.RestoreEnv(os.Environ())
+	_, err := parser.Parse(lexer.NewMode(text, lexer.NoEval))
+	return err
+}
+
+// complete returns the field names inside command blocks and the directive keys after "#<".
+func complete(text string, pos position) []completionItem {
+	lines := splitLines(text)
+	if pos.Line >= len(lines) {
+		return []completionItem{}
+	}
+	before := strings.TrimSpace(lines[pos.Line][:byteOffset(lines[pos.Line], pos.Character)])
+	items := []completionItem{}
+	switch {
+	case isDirectiveStart(before):
+		for _, key := range sortedKeys(directiveDocs) {
+			items = append(items, completionItem{
+				Label:         key,
+				Kind:          completionKeyword,
+				Documentation: &markupContent{Kind: "markdown", Value: directiveDocs[key]},
+			})
+		}
+	case isKey(before) && inBlock(lines, pos.Line):
+		for _, key := range parser.FieldNames() {
+			items = append(items, completionItem{
+				Label:         key,
+				Kind:          completionField,
+				Documentation: &markupContent{Kind: "markdown", Value: fieldDocs[key]},
+				InsertText:    key + ":= ",
+			})
+		}
+	}
+	return items
+}
+
+// hoverAt returns the docs of the field or directive at pos, or nil if there's none.
+func hoverAt(text string, pos position) *hover {
+	lines := splitLines(text)
+	if pos.Line >= len(lines) {
+		return nil
+	}
+	line := lines[pos.Line]
+	start, end := wordAt(line, byteOffset(line, pos.Character))
+	if start == end {
+		return nil
+	}
+	key := strings.ToLower(line[start:end])
+	before := strings.TrimSpace(line[:start])
+	after := strings.TrimSpace(line[end:])
+	var doc string
+	switch {
+	case before == "" && strings.HasPrefix(after, ":=") && inBlock(lines, pos.Line):
+		doc = fieldDocs[key]
+	case strings.HasPrefix(before, "#") && strings.HasSuffix(before, "<"):
+		doc = directiveDocs[key]
+	}
+	if doc == "" {
+		return nil
+	}
+	r := textRange{
+		Start: position{pos.Line, utf16Len(line[:start])},
+		End:   position{pos.Line, utf16Len(line[:end])},
+	}
+	return &hover{Contents: markupContent{Kind: "markdown", Value: doc}, Range: &r}
+}
+
+// definition returns where the variable or job referenced at pos is defined,
+// as in $var, ${var} or @job, or nil if it isn't a reference to a known one.
+func definition(uri, text string, pos position) *location {
+	lines := splitLines(text)
+	if pos.Line >= len(lines) {
+		return nil
+	}
+	line := lines[pos.Line]
+	start, end := wordAt(line, byteOffset(line, pos.Character))
+	if start == end {
+		return nil
+	}
+	name := line[start:end]
+	f, err := syntax.Parse(text)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case strings.HasSuffix(line[:start], "$") || strings.HasSuffix(line[:start], "${"):
+		// the last assignment before the reference, or the first one after it
+		var def *syntax.Word
+		for _, n := range f.Nodes {
+			v, ok := n.(*syntax.Variable)
+			if !ok || v.Name.Value != name {
+				continue
+			}
+			if def == nil || v.Name.Line <= pos.Line {
+				w := v.Name
+				def = &w
+			}
+		}
+		if def != nil {
+			return wordLocation(uri, lines, *def, name)
+		}
+	case strings.HasSuffix(line[:start], "@"):
+		for _, n := range f.Nodes {
+			cmd, ok := n.(*syntax.Command)
+			if !ok {
+				continue
+			}
+			if field := nameField(cmd); field != nil && field.Values[0].Value == name {
+				return wordLocation(uri, lines, field.Values[0], name)
+			}
+		}
+	}
+	return nil
+}
+
+// symbols returns the variables and command blocks of text, with the fields of the blocks as their children.
+func symbols(text string) []documentSymbol {
+	syms := []documentSymbol{}
+	f, err := syntax.Parse(text)
+	if err != nil {
+		return syms
+	}
+	lines := splitLines(text)
+	for _, n := range f.Nodes {
+		switch n := n.(type) {
+		case *syntax.Variable:
+			r := lineRange(text, n.Name.Line)
+			value := ""
+			if n.Value != nil {
+				value = n.Value.Value
+			}
+			syms = append(syms, documentSymbol{
+				Name:           n.Name.Value,
+				Detail:         value,
+				Kind:           symbolVariable,
+				Range:          r,
+				SelectionRange: r,
+			})
+		case *syntax.Command:
+			if !n.Block {
+				continue
+			}
+			words := make([]string, len(n.Words))
+			for i, w := range n.Words {
+				words[i] = w.Value
+			}
+			sym := documentSymbol{
+				Name:   strings.Join(words, " "),
+				Kind:   symbolFunction,
+				Range:  spanRange(lines, n.Line, n.EndLine),
+				Detail: strings.Join(words, " "),
+			}
+			if field := nameField(n); field != nil {
+				sym.Name = field.Values[0].Value
+			}
+			sym.SelectionRange = lineRange(text, n.Line)
+			for _, child := range n.Body {
+				field, ok := child.(*syntax.Field)
+				if !ok {
+					continue
+				}
+				values := make([]string, len(field.Values))
+				for i, v := range field.Values {
+					values[i] = v.Raw
+				}
+				r := lineRange(text, field.Key.Line)
+				sym.Children = append(sym.Children, documentSymbol{
+					Name:           strings.ToLower(field.Key.Value),
+					Detail:         strings.Join(values, " "),
+					Kind:           symbolProperty,
+					Range:          r,
+					SelectionRange: r,
+				})
+			}
+			syms = append(syms, sym)
+		}
+	}
+	return syms
+}
+
+// nameField returns the name:= field of a command block with a value, or nil if it has none.
+func nameField(cmd *syntax.Command) *syntax.Field {
+	for _, n := range cmd.Body {
+		if f, ok := n.(*syntax.Field); ok && strings.EqualFold(f.Key.Value, "name") && len(f.Values) > 0 {
+			return f
+		}
+	}
+	return nil
+}
+
+// inBlock reports whether the line n, counted from 0, is inside a command block:
+// after a line ending in '{' and before the line starting with the '}' closing it.
+func inBlock(lines []string, n int) bool {
+	depth := 0
+	for i := 0; i < n && i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if c := strings.Index(line, " #"); c >= 0 {
+			line = strings.TrimSpace(line[:c])
+		}
+		switch {
+		case strings.HasPrefix(line, "#"):
+		case strings.HasSuffix(line, "{"):
+			depth++
+		case strings.HasPrefix(line, "}") && depth > 0:
+			depth--
+		}
+	}
+	return depth > 0
+}
+
+// isDirectiveStart reports whether s is the start of a directive up to its key, such as "#<max".
+func isDirectiveStart(s string) bool {
+	if !strings.HasPrefix(s, "#") {
+		return false
+	}
+	s = strings.TrimSpace(s[1:])
+	return strings.HasPrefix(s, "<") && isKey(s[1:])
+}
+
+func isKey(s string) bool {
+	for _, c := range s {
+		if !unicode.IsLetter(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// wordAt returns the bounds of the word of letters, digits and underscores around the byte offset i of line.
+func wordAt(line string, i int) (start, end int) {
+	isWord := func(c byte) bool {
+		return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+	}
+	start, end = i, i
+	for start > 0 && isWord(line[start-1]) {
+		start--
+	}
+	for end < len(line) && isWord(line[end]) {
+		end++
+	}
+	return start, end
+}
+
+// wordLocation returns the location of name in the line of w.
+func wordLocation(uri string, lines []string, w syntax.Word, name string) *location {
+	n := w.Line
+	if n < 0 || n >= len(lines) {
+		return nil
+	}
+	line := lines[n]
+	start := strings.Index(line, name)
+	if start < 0 {
+		start = 0
+	}
+	end := start + len(name)
+	if end > len(line) {
+		end = len(line)
+	}
+	return &location{URI: uri, Range: textRange{
+		Start: position{n, utf16Len(line[:start])},
+		End:   position{n, utf16Len(line[:end])},
+	}}
+}
+
+// lineRange returns the range of the whole line n, counted from 0.
+func lineRange(text string, n int) textRange {
+	lines := splitLines(text)
+	return spanRange(lines, n, n)
+}
+
+// spanRange returns the range from the start of the line first to the end of the line last.
+func spanRange(lines []string, first, last int) textRange {
+	if last >= len(lines) {
+		last = len(lines) - 1
+	}
+	if first > last {
+		first = last
+	}
+	if first < 0 {
+		return textRange{}
+	}
+	return textRange{
+		Start: position{first, 0},
+		End:   position{last, utf16Len(lines[last])},
+	}
+}
+
+func splitLines(text string) []string {
+	return strings.Split(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(text), "\n")
+}
+
+// utf16Len returns the length of s in UTF-16 code units, which positions are counted in.
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// byteOffset returns the byte offset in line of the UTF-16 offset char.
+func byteOffset(line string, char int) int {
+	n := 0
+	for i, c := range line {
+		if n >= char {
+			return i
+		}
+		n += len(utf16.Encode([]rune{c}))
+	}
+	return len(line)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
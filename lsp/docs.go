@@ -0,0 +1,45 @@
+package lsp
+
+// fieldDocs are the hover docs of the fields of command blocks.
+var fieldDocs = map[string]string{
+	"name":             "`name:= <name>`\n\nThe name of the job, used in errors, prefixes and `@name` references.",
+	"stdin":            "`stdin:= <file> | !stdin | !null | @job | <<DELIM`\n\nWhat the command reads from: a file, the standard input of the script, nothing, the output of another job or a here-document.",
+	"input":            "`input:= <text> | <<DELIM`\n\nText given to the command as its standard input.",
+	"stdout":           "`stdout:= [>|>>]<target>...`\n\nWhere the standard output goes: files (`>>` appends), `!stdout`, `!stderr`, `!null`, `!capture` or `@job`. Several targets all get a copy.",
+	"stderr":           "`stderr:= [>|>>]<target>...`\n\nWhere the standard error goes: files (`>>` appends), `!stdout`, `!stderr`, `!null`, `!capture` or `@job`. Several targets all get a copy.",
+	"append":           "`append:= true | false`\n\nAppend to the redirect files without an explicit `>` or `>>` instead of truncating them.",
+	"mkdir":            "`mkdir:= true | false`\n\nCreate the missing parent directories of redirect files.",
+	"filemode":         "`filemode:= <octal>`\n\nThe permissions of created files, such as `0644`.",
+	"times":            "`times:= <n>`\n\nHow many times the command runs; with `every:=`, the number of scheduled runs.",
+	"sync":             "`sync:= true | false`\n\nWait for the command to finish before starting the next one. Commands are asynchronous by default; the `:` prefix is a shorthand for `sync:= true`.",
+	"rotate":           "`rotate:= <size> | daily`\n\nRotate the redirect files when they'd grow past a size such as `10MB`, or on a new day.",
+	"keep":             "`keep:= <n>`\n\nHow many rotated files are kept, 0 keeps all of them. Needs `rotate:=`.",
+	"compress":         "`compress:= gzip | none`\n\nCompress rotated files. Needs `rotate:=`.",
+	"prefix":           "`prefix:= auto | off | <text>`\n\nWrite a prefix before every line of output; `auto` uses the name of the job.",
+	"timestamps":       "`timestamps:= true | false | rfc3339 | elapsed`\n\nWrite a timestamp before every line of output.",
+	"every":            "`every:= <duration>`\n\nRun the command repeatedly, on ticks aligned to the wall clock, such as `30s`, `5m` or `1h`. Without `times:=`, it repeats forever.",
+	"dir":              "`dir:= <path>`\n\nThe working directory of the command; relative redirect paths are resolved against it.",
+	"workingdirectory": "`workingdirectory:= <path>`\n\nThe same as `dir:=`.",
+	"jitter":           "`jitter:= <duration>`\n\nDelay every run by a random duration up to this one.",
+	"splay":            "`splay:= <duration>`\n\nDelay every run by a duration up to this one that is stable for the job on a host.",
+	"pool":             "`pool:= <name>`\n\nThe concurrency pool the runs count against, limited by a `#<pool name=n>` directive.",
+	"priority":         "`priority:= <n>`\n\nRuns with a higher priority get a free slot of the concurrency limits first.",
+	"lock":             "`lock:= <name>`\n\nRuns of jobs with the same lock never overlap.",
+	"lockfile":         "`lockfile:= <path>`\n\nTake an exclusive lock on a file for every run, shared with other processes.",
+	"overlap":          "`overlap:= skip | queue | parallel | replace`\n\nWhat happens when a repeating command is due while its previous run is still going.",
+}
+
+// directiveDocs are the hover docs of #<key=value> directives.
+var directiveDocs = map[string]string{
+	"maxparallel":      "`#<maxparallel=n>`\n\nLimit how many commands may run at once, 0 means no limit.",
+	"pool":             "`#<pool name=n>`\n\nLimit how many commands may run in the pool at once.",
+	"dir":              "`#<dir=path>`\n\nThe default `dir:=` of the commands after it.",
+	"workingdirectory": "`#<workingdirectory=path>`\n\nThe same as `#<dir=path>`.",
+	"sync":             "`#<sync=true|false>`\n\nThe default `sync:=` of the commands after it.",
+	"prefix":           "`#<prefix=auto|off>`\n\nPrefix the output of the commands after it with their names.",
+	"singleton":        "`#<singleton=exit|wait|replace>`\n\nAllow only one instance of the script to run at a time.",
+	"mininterval":      "`#<mininterval=duration>`\n\nThe shortest interval allowed in `every:=` fields, 30s by default.",
+	"stdin":            "`#<stdin=target>`\n\nThe default `stdin:=` of the commands after it.",
+	"stdout":           "`#<stdout=targets>`\n\nThe default `stdout:=` of the commands after it.",
+	"stderr":           "`#<stderr=targets>`\n\nThe default `stderr:=` of the commands after it.",
+}
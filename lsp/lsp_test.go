@@ -0,0 +1,198 @@
+package lsp
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/insomnimus/inscript/parser"
+	"io"
+	"strings"
+	"testing"
+)
+
+const script = `greeting:= hello
+#<maxparallel=2>
+@ echo $greeting {
+	name:= producer
+	every:= 1m
+}
+@ cat {
+	stdin:= @producer
+	stdot:= out.log
+}
+`
+
+// client talks to a server running in the background.
+type client struct {
+	t    *testing.T
+	conn *conn
+	id   int
+	done chan error
+}
+
+func newClient(t *testing.T) *client {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := &client{t: t, conn: newConn(outR, inW), done: make(chan error, 1)}
+	go func() {
+		c.done <- Serve(inR, outW)
+		outW.Close()
+	}()
+	return c
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.t.Helper()
+	raw, _ := json.Marshal(params)
+	if err := c.conn.write(&message{Method: method, Params: raw}); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// call sends a request and decodes the result of its response into result.
+func (c *client) call(method string, params, result interface{}) {
+	c.t.Helper()
+	c.id++
+	raw, _ := json.Marshal(params)
+	id := json.RawMessage(fmt.Sprint(c.id))
+	if err := c.conn.write(&message{ID: &id, Method: method, Params: raw}); err != nil {
+		c.t.Fatal(err)
+	}
+	m := c.read()
+	if m.Error != nil {
+		c.t.Fatalf("%s returned error: %s", method, m.Error.Message)
+	}
+	if err := json.Unmarshal(m.Result, result); err != nil {
+		c.t.Fatalf("decoding the result of %s: %s", method, err)
+	}
+}
+
+func (c *client) read() *message {
+	c.t.Helper()
+	m, err := c.conn.read()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+func at(line, char int) textDocumentPositionParams {
+	return textDocumentPositionParams{
+		TextDocument: textDocumentIdentifier{URI: "file:///x.ins"},
+		Position:     position{line, char},
+	}
+}
+
+func TestServer(t *testing.T) {
+	c := newClient(t)
+	var init map[string]interface{}
+	c.call("initialize", map[string]interface{}{}, &init)
+	if _, ok := init["capabilities"]; !ok {
+		t.Errorf("expected capabilities in the initialize result, got %v", init)
+	}
+	c.notify("initialized", struct{}{})
+
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]string{"uri": "file:///x.ins", "text": script},
+	})
+	var diags publishDiagnosticsParams
+	if err := json.Unmarshal(c.read().Params, &diags); err != nil {
+		t.Fatal(err)
+	}
+	if len(diags.Diagnostics) != 1 || diags.Diagnostics[0].Range.Start.Line != 8 ||
+		!strings.Contains(diags.Diagnostics[0].Message, `did you mean "stdout"?`) {
+		t.Errorf("expected a diagnostic for stdot on line 8, got %+v", diags.Diagnostics)
+	}
+
+	var items []completionItem
+	c.call("textDocument/completion", at(8, 3), &items)
+	if len(items) != len(parser.FieldNames()) {
+		t.Errorf("expected the %d field names in a block, got %d items", len(parser.FieldNames()), len(items))
+	}
+	c.call("textDocument/completion", at(1, 5), &items)
+	if len(items) != len(directiveDocs) {
+		t.Errorf("expected the %d directive keys after #<, got %d items", len(directiveDocs), len(items))
+	}
+	c.call("textDocument/completion", at(0, 3), &items)
+	if len(items) != 0 {
+		t.Errorf("expected no completions outside blocks, got %d", len(items))
+	}
+
+	var h hover
+	c.call("textDocument/hover", at(4, 2), &h)
+	if h.Contents.Value != fieldDocs["every"] {
+		t.Errorf("expected the docs of every:=, got %q", h.Contents.Value)
+	}
+
+	var loc location
+	c.call("textDocument/definition", at(2, 10), &loc)
+	if loc.Range.Start != (position{0, 0}) || loc.Range.End != (position{0, 8}) {
+		t.Errorf("expected $greeting to be defined at 0:0-0:8, got %+v", loc.Range)
+	}
+	c.call("textDocument/definition", at(7, 12), &loc)
+	if loc.Range.Start != (position{3, 8}) {
+		t.Errorf("expected @producer to be defined at 3:8, got %+v", loc.Range)
+	}
+
+	var syms []documentSymbol
+	c.call("textDocument/documentSymbol", map[string]interface{}{
+		"textDocument": textDocumentIdentifier{URI: "file:///x.ins"},
+	}, &syms)
+	var names []string
+	for _, s := range syms {
+		names = append(names, s.Name)
+	}
+	if strings.Join(names, ",") != "greeting,producer,cat" {
+		t.Errorf("expected the symbols greeting, producer and cat, got %v", names)
+	}
+	if len(syms) == 3 && (syms[1].Range.End.Line != 5 || len(syms[1].Children) != 2) {
+		t.Errorf("expected the producer block to span lines 2-5 with 2 fields, got %+v", syms[1])
+	}
+
+	var null interface{}
+	c.call("shutdown", nil, &null)
+	c.notify("exit", nil)
+	if err := <-c.done; err != nil {
+		t.Errorf("Serve returned error: %s", err)
+	}
+}
+
+func TestTrailingBackslash(t *testing.T) {
+	c := newClient(t)
+	var init map[string]interface{}
+	c.call("initialize", map[string]interface{}{}, &init)
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]string{"uri": "file:///x.ins", "text": "echo hi\n\\"},
+	})
+	var diags publishDiagnosticsParams
+	if err := json.Unmarshal(c.read().Params, &diags); err != nil {
+		t.Fatal(err)
+	}
+	if len(diags.Diagnostics) != 1 || diags.Diagnostics[0].Range.Start.Line != 1 ||
+		!strings.Contains(diags.Diagnostics[0].Message, "unterminated escape") {
+		t.Errorf("expected a diagnostic for the backslash on line 1, got %+v", diags.Diagnostics)
+	}
+	var syms []documentSymbol
+	c.call("textDocument/documentSymbol", map[string]interface{}{
+		"textDocument": textDocumentIdentifier{URI: "file:///x.ins"},
+	}, &syms)
+
+	var null interface{}
+	c.call("shutdown", nil, &null)
+	c.notify("exit", nil)
+	if err := <-c.done; err != nil {
+		t.Errorf("Serve returned error: %s", err)
+	}
+}
+
+func TestFieldDocs(t *testing.T) {
+	for _, name := range parser.FieldNames() {
+		if fieldDocs[name] == "" {
+			t.Errorf("the %s field has no docs", name)
+		}
+	}
+	for _, name := range parser.DirectiveNames() {
+		if directiveDocs[name] == "" {
+			t.Errorf("the %s directive has no docs", name)
+		}
+	}
+}
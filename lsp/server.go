@@ -0,0 +1,164 @@
+// Package lsp implements a language server for scripts, speaking the Language Server Protocol.
+package lsp
+
+import (
+	"encoding/json"
+	"io"
+)
+
+type server struct {
+	conn *conn
+	// the text of the open documents by URI
+	docs map[string]string
+}
+
+// Serve speaks the Language Server Protocol over r and w
+// until the client sends an exit notification or r ends.
+func Serve(r io.Reader, w io.Writer) error {
+	s := &server{
+		conn: newConn(r, w),
+		docs: make(map[string]string),
+	}
+	for {
+		m, err := s.conn.read()
+		if err == io.EOF {
+			return nil
+		}
+		if rerr, ok := err.(*responseError); ok {
+			if err := s.conn.write(&message{ID: nullID(), Error: rerr}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if m.Method == "exit" {
+			return nil
+		}
+
+		result, err := s.handle(m)
+		// notifications get no response
+		if m.ID == nil {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		reply := &message{ID: m.ID}
+		if err != nil {
+			rerr, ok := err.(*responseError)
+			if !ok {
+				return err
+			}
+			reply.Error = rerr
+		} else if reply.Result, err = json.Marshal(result); err != nil {
+			return err
+		}
+		if err := s.conn.write(reply); err != nil {
+			return err
+		}
+	}
+}
+
+func nullID() *json.RawMessage {
+	id := json.RawMessage("null")
+	return &id
+}
+
+// handle handles a request or notification and returns its result.
+// The error is a *responseError if it's to be sent to the client.
+func (s *server) handle(m *message) (interface{}, error) {
+	switch m.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				// the whole document is sent on changes
+				"textDocumentSync":       1,
+				"completionProvider":     map[string]interface{}{"triggerCharacters": []string{"<"}},
+				"hoverProvider":          true,
+				"definitionProvider":     true,
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "inscript"},
+		}, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := json.Unmarshal(m.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return nil, s.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := json.Unmarshal(m.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			return nil, s.update(params.TextDocument.URI, params.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := json.Unmarshal(m.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		delete(s.docs, params.TextDocument.URI)
+		return nil, s.publish(params.TextDocument.URI, nil)
+	case "textDocument/completion", "textDocument/hover", "textDocument/definition":
+		var params textDocumentPositionParams
+		if err := json.Unmarshal(m.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		text := s.docs[params.TextDocument.URI]
+		switch m.Method {
+		case "textDocument/completion":
+			return complete(text, params.Position), nil
+		case "textDocument/hover":
+			if h := hoverAt(text, params.Position); h != nil {
+				return h, nil
+			}
+			return nil, nil
+		default:
+			if loc := definition(params.TextDocument.URI, text, params.Position); loc != nil {
+				return loc, nil
+			}
+			return nil, nil
+		}
+	case "textDocument/documentSymbol":
+		var params struct {
+			TextDocument textDocumentIdentifier `json:"textDocument"`
+		}
+		if err := json.Unmarshal(m.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return symbols(s.docs[params.TextDocument.URI]), nil
+	default:
+		if m.ID == nil {
+			return nil, nil
+		}
+		return nil, &responseError{Code: codeMethodNotFound, Message: "method not found: " + m.Method}
+	}
+}
+
+func invalidParams(err error) error {
+	return &responseError{Code: codeInvalidParams, Message: err.Error()}
+}
+
+// update stores the text of a document and publishes its diagnostics.
+func (s *server) update(uri, text string) error {
+	s.docs[uri] = text
+	return s.publish(uri, diagnose(text))
+}
+
+func (s *server) publish(uri string, ds []diagnostic) error {
+	if ds == nil {
+		ds = []diagnostic{}
+	}
+	params, err := json.Marshal(publishDiagnosticsParams{URI: uri, Diagnostics: ds})
+	if err != nil {
+		return err
+	}
+	return s.conn.write(&message{Method: "textDocument/publishDiagnostics", Params: params})
+}
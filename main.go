@@ -1,25 +1,252 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/insomnimus/inscript/ast"
+	"github.com/insomnimus/inscript/jobfile"
 	"github.com/insomnimus/inscript/lexer"
+	"github.com/insomnimus/inscript/lsp"
 	"github.com/insomnimus/inscript/parser"
 	"github.com/insomnimus/inscript/runtime"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
+const usage = `usage: inscript [options] <script> [args...]
+       inscript simulate [simulate options] <script> [args...]
+       inscript check [check options] <script>...
+       inscript fmt [fmt options] [script...]
+       inscript parse [parse options] <script> [args...]
+       inscript import crontab [-tz <zone>] <crontab>
+       inscript lsp
+
+options:
+  -min-interval <duration>
+    	the shortest interval allowed in every:= fields,
+    	overrides #<mininterval=...> directives (default 30s)
+  -format ins|json|yaml|toml
+    	the format of the script; by default, files ending in .json, .yaml, .yml
+    	or .toml are job files in that format and other files are scripts
+  -lock[=exit|wait|replace]
+    	allow only one instance of the script to run at a time,
+    	overrides #<singleton=...> directives; if another instance is running,
+    	exit with status 3 (the default), wait for it or replace it
+  -dry-run
+    	print the commands the script would run, without running anything;
+    	command substitutions such as $(date) are shown unevaluated
+  -h, --help
+    	show this message and exit
+
+simulate options:
+  -min-interval <duration>, -format <format>
+    	as above
+  -for <duration>
+    	how long a span of time to simulate (default 24h)
+  -duration <duration> | <job>=<duration>
+    	how long the runs of every job, or of the named job, take;
+    	may be repeated, runs finish instantly by default
+
+simulate runs the schedule of the script against a simulated clock
+without starting any command, printing when every run would start and end
+and which other runs it would overlap with
+
+check options:
+  -min-interval <duration>, -format <format>
+    	as above
+  -json
+    	print the problems as a JSON array
+
+check parses scripts without running anything and reports their problems:
+syntax errors, unknown fields and directives, commands that aren't found,
+jobs that may write the same file at the same time or read a file
+another job writes, sync:= true on jobs that repeat forever, which run
+in the background anyway, and unused variables;
+it exits with status 1 if any script has errors
+
+fmt options:
+  -l
+    	list the scripts whose formatting differs from the canonical one
+  -w
+    	write the result to the script instead of printing it
+  -d
+    	print the changes formatting would make as a diff
+
+fmt prints scripts in canonical form, keeping their comments and directives;
+without scripts, it formats the standard input
+
+parse options:
+  -min-interval <duration>, -format <format>
+    	as above
+  -json
+    	print the program as JSON
+
+parse prints the parsed script: its settings, variables and commands,
+with the directives in effect applied to every command;
+command substitutions such as $(date) are shown unevaluated
+
+job files list jobs with the command, its args and the fields of command blocks,
+such as {"jobs": [{"command": "tar", "args": ["czf", "a.tgz", "a"], "every": "1h"}]};
+their other keys are directives; their values are taken literally
+
+import crontab prints the script equivalent to a crontab, or to the standard input if it's -;
+-tz sets the time zone of its schedules, the local one by default, unless it sets CRON_TZ;
+entries that can't be translated exactly are left commented out with a warning
+
+lsp runs a language server for scripts, speaking the Language Server Protocol
+over the standard input and output`
+
+// durationFlag is a flag.Value accepting any duration parser.ParseDuration understands.
+type durationFlag struct {
+	d   time.Duration
+	set bool
+}
+
+func (f *durationFlag) String() string {
+	if f == nil || !f.set {
+		return ""
+	}
+	return f.d.String()
+}
+
+func (f *durationFlag) Set(s string) error {
+	d, err := parser.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	f.d = d
+	f.set = true
+	return nil
+}
+
+// formatFlag is a flag.Value for -format, the format of the script.
+type formatFlag struct {
+	format jobfile.Format
+	// the script is a script whatever its extension
+	ins bool
+}
+
+func (f *formatFlag) String() string {
+	if f == nil || f.ins {
+		return "ins"
+	}
+	return string(f.format)
+}
+
+func (f *formatFlag) Set(s string) error {
+	if strings.ToLower(s) == "ins" {
+		f.format, f.ins = "", true
+		return nil
+	}
+	format, err := jobfile.ParseFormat(s)
+	if err != nil {
+		return fmt.Errorf("unknown format %q, expected ins, json, yaml or toml", s)
+	}
+	f.format, f.ins = format, false
+	return nil
+}
+
+// of returns the format of the job file at path,
+// or false if it's a script.
+func (f *formatFlag) of(path string) (jobfile.Format, bool) {
+	if f.ins {
+		return "", false
+	}
+	if f.format != "" {
+		return f.format, true
+	}
+	return jobfile.FormatOf(path)
+}
+
+// durationsFlag is a flag.Value for simulate -duration,
+// accepting a duration for every job or job=duration for the job with that name or command.
+type durationsFlag struct {
+	all  time.Duration
+	jobs map[string]time.Duration
+}
+
+func (f *durationsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.all.String()
+}
+
+func (f *durationsFlag) Set(s string) error {
+	job, val := "", s
+	if i := strings.LastIndexByte(s, '='); i >= 0 {
+		job, val = strings.TrimSpace(s[:i]), s[i+1:]
+		if job == "" {
+			return fmt.Errorf("missing job name in %q", s)
+		}
+	}
+	d, err := parser.ParseDuration(val)
+	if err != nil {
+		return err
+	}
+	if job == "" {
+		f.all = d
+		return nil
+	}
+	if f.jobs == nil {
+		f.jobs = make(map[string]time.Duration)
+	}
+	f.jobs[job] = d
+	return nil
+}
+
+// of returns how long the runs of cmd take.
+func (f *durationsFlag) of(cmd *ast.Command) time.Duration {
+	if d, ok := f.jobs[cmd.Name]; ok && cmd.Name != "" {
+		return d
+	}
+	if d, ok := f.jobs[cmd.Command]; ok {
+		return d
+	}
+	return f.all
+}
+
+// exitLocked is the exit status when another instance of a singleton script is running.
+const exitLocked = 3
+
+// lockFlag is a flag.Value for -lock, which may be given with or without a mode.
+type lockFlag struct {
+	mode ast.Singleton
+	set  bool
+}
+
+func (f *lockFlag) IsBoolFlag() bool { return true }
+
+func (f *lockFlag) String() string {
+	if f == nil || !f.set {
+		return ""
+	}
+	return f.mode.String()
+}
+
+func (f *lockFlag) Set(s string) error {
+	mode, err := parser.ParseSingleton(s)
+	if err != nil {
+		return err
+	}
+	f.mode = mode
+	f.set = true
+	return nil
+}
+
 func showAbout() {
 	log.Println("inscript interpreter\nuse inscript --help for the usage")
 	os.Exit(0)
 }
 
 func showHelp() {
-	log.Println("help coming soon")
+	log.Println(usage)
 	os.Exit(0)
 }
 
@@ -29,65 +256,175 @@ func main() {
 	if len(os.Args) == 1 {
 		showAbout()
 	}
-	if os.Args[1] == "-h" || os.Args[1] == "--help" {
-		showHelp()
+	switch os.Args[1] {
+	case "simulate":
+		simulate(os.Args[2:])
+		return
+	case "check":
+		check(os.Args[2:])
+		return
+	case "fmt":
+		format(os.Args[2:])
+		return
+	case "parse":
+		parse(os.Args[2:])
+		return
+	case "import":
+		importFrom(os.Args[2:])
+		return
+	case "lsp":
+		if err := lsp.Serve(os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	data, err := os.ReadFile(os.Args[1])
-	if err != nil {
-		log.Fatal(err)
+	var (
+		minInterval durationFlag
+		format      formatFlag
+		lock        lockFlag
+		dryRun      bool
+	)
+	flags := flag.NewFlagSet("inscript", flag.ContinueOnError)
+	flags.Usage = func() {}
+	flags.Var(&minInterval, "min-interval", "")
+	flags.Var(&format, "format", "")
+	flags.Var(&lock, "lock", "")
+	flags.BoolVar(&dryRun, "dry-run", false, "")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			showHelp()
+		}
+		log.Fatal(usage)
 	}
-	for i, a := range os.Args[1:] {
-		os.Setenv(fmt.Sprint(i), a)
+	args := flags.Args()
+	if len(args) == 0 {
+		log.Fatal(usage)
 	}
-	os.Setenv("#", fmt.Sprint(len(os.Args)-2))
-	os.Setenv("@", strings.Join(os.Args[2:], " "))
-	l := lexer.New(string(data))
-	p, err := parser.New(l)
-	if err != nil {
-		log.Fatal(err)
-	}
-	var commands []*ast.Command
-
-	for cmd, err := p.Next(); err != &parser.ErrEOF; cmd, err = p.Next() {
+	if dryRun {
+		prog, err := load(args, format, lexer.NoEval, minInterval)
 		if err != nil {
 			log.Fatal(err)
 		}
-		commands = append(commands, cmd)
+		r := runtime.NewRunner(prog.Settings)
+		r.Dir = filepath.Dir(args[0])
+		if err := r.DryRun(os.Stdout, prog.Commands); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	done := make(chan struct{}, len(commands))
 
-	for _, cmd := range commands {
-		pr, err := runtime.CreateProcess(cmd)
+	// the lock is taken before the script is parsed to be run, which runs its command substitutions;
+	// the directives it's read from need no substitutions
+	singleton := lock.mode
+	if !lock.set {
+		prog, err := load(args, format, lexer.NoEval, minInterval)
 		if err != nil {
 			log.Fatal(err)
 		}
-		time.Sleep(10 * time.Millisecond)
-		if pr.Async {
-			//shouldWait = true
-			go func() {
-				err := pr.Run()
-				if err != nil {
-					log.Fatal(err)
-				}
-				done <- struct{}{}
-			}()
-			continue
+		singleton = prog.Settings.Singleton
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	release, err := runtime.LockScript(ctx, args[0], singleton)
+	if errors.Is(err, runtime.ErrLocked) {
+		log.Printf("%s: %s", args[0], err)
+		os.Exit(exitLocked)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return
 		}
-		err = pr.Run()
-		if err != nil {
-			log.Fatal(err)
+		log.Fatal(err)
+	}
+	err = runScript(ctx, args, format, minInterval)
+	// released before exiting, which skips deferred calls
+	release()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runScript parses the script or job file args[0] and runs it until it finishes or ctx is cancelled.
+func runScript(ctx context.Context, args []string, format formatFlag, minInterval durationFlag) error {
+	prog, err := load(args, format, 0, minInterval)
+	if err != nil {
+		return err
+	}
+	r := runtime.NewRunner(prog.Settings)
+	r.Dir = filepath.Dir(args[0])
+	// on interrupt the context is cancelled, which stops every running process
+	return r.Run(ctx, prog.Commands)
+}
+
+// simulate runs the simulate subcommand with the arguments following it.
+func simulate(argv []string) {
+	var (
+		minInterval durationFlag
+		format      formatFlag
+		span        = durationFlag{d: 24 * time.Hour}
+		durations   durationsFlag
+	)
+	flags := flag.NewFlagSet("inscript simulate", flag.ContinueOnError)
+	flags.Usage = func() {}
+	flags.Var(&minInterval, "min-interval", "")
+	flags.Var(&format, "format", "")
+	flags.Var(&span, "for", "")
+	flags.Var(&durations, "duration", "")
+	if err := flags.Parse(argv); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			showHelp()
 		}
-		done <- struct{}{}
+		log.Fatal(usage)
+	}
+	args := flags.Args()
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+	if span.d <= 0 {
+		log.Fatal("the simulated span must be positive")
+	}
 
+	prog, err := load(args, format, lexer.NoEval, minInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r := runtime.NewRunner(prog.Settings)
+	r.Dir = filepath.Dir(args[0])
+	start := time.Now()
+	events, err := r.Simulate(prog.Commands, start, span.d, durations.of)
+	runtime.WriteSimulation(os.Stdout, start, events)
+	if err != nil {
+		log.Fatal(err)
 	}
+}
 
-	sig := make(chan os.Signal, 2)
-	signal.Notify(sig, os.Interrupt)
-	for i := 0; i < len(commands); i++ {
-		select {
-		case <-sig:
-			return
-		case <-done:
+// load reads and parses the script or job file args[0], passing it the rest of args.
+func load(args []string, format formatFlag, mode lexer.Mode, minInterval durationFlag) (*ast.Program, error) {
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := format.of(args[0]); ok {
+		p := parser.NewStructured()
+		if minInterval.set {
+			p.SetMinInterval(minInterval.d)
 		}
+		return jobfile.Parse(p, data, f)
+	}
+	for i, a := range args {
+		os.Setenv(fmt.Sprint(i), a)
+	}
+	os.Setenv("#", fmt.Sprint(len(args)-1))
+	os.Setenv("@", strings.Join(args[1:], " "))
+	l := lexer.NewMode(string(data), mode)
+	p, err := parser.New(l)
+	if err != nil {
+		return nil, err
+	}
+	if minInterval.set {
+		p.SetMinInterval(minInterval.d)
 	}
+	return p.Program()
 }
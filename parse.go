@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/insomnimus/inscript/lexer"
+	"log"
+	"os"
+)
+
+// parse runs the parse subcommand with the arguments following it.
+func parse(argv []string) {
+	var (
+		minInterval durationFlag
+		format      formatFlag
+		asJSON      bool
+	)
+	flags := flag.NewFlagSet("inscript parse", flag.ContinueOnError)
+	flags.Usage = func() {}
+	flags.Var(&minInterval, "min-interval", "")
+	flags.Var(&format, "format", "")
+	flags.BoolVar(&asJSON, "json", false, "")
+	if err := flags.Parse(argv); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			showHelp()
+		}
+		log.Fatal(usage)
+	}
+	args := flags.Args()
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+
+	prog, err := load(args, format, lexer.NoEval, minInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(prog); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	fmt.Printf("Settings: %+v\n", prog.Settings)
+	for _, v := range prog.Variables {
+		fmt.Printf("line %d: %s:= %q\n", v.Line, v.Name, v.Value)
+	}
+	for _, cmd := range prog.Commands {
+		fmt.Printf("line %d: %#v\n", cmd.Line, *cmd)
+	}
+}
@@ -0,0 +1,168 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var durationUnits = map[string]time.Duration{
+	"ns":           time.Nanosecond,
+	"nanosecond":   time.Nanosecond,
+	"nanoseconds":  time.Nanosecond,
+	"us":           time.Microsecond,
+	"µs":           time.Microsecond,
+	"microsecond":  time.Microsecond,
+	"microseconds": time.Microsecond,
+	"ms":           time.Millisecond,
+	"millisecond":  time.Millisecond,
+	"milliseconds": time.Millisecond,
+	"s":            time.Second,
+	"sec":          time.Second,
+	"secs":         time.Second,
+	"second":       time.Second,
+	"seconds":      time.Second,
+	"m":            time.Minute,
+	"min":          time.Minute,
+	"mins":         time.Minute,
+	"minute":       time.Minute,
+	"minutes":      time.Minute,
+	"h":            time.Hour,
+	"hr":           time.Hour,
+	"hrs":          time.Hour,
+	"hour":         time.Hour,
+	"hours":        time.Hour,
+	"d":            24 * time.Hour,
+	"day":          24 * time.Hour,
+	"days":         24 * time.Hour,
+	"w":            7 * 24 * time.Hour,
+	"wk":           7 * 24 * time.Hour,
+	"wks":          7 * 24 * time.Hour,
+	"week":         7 * 24 * time.Hour,
+	"weeks":        7 * 24 * time.Hour,
+}
+
+// ParseDuration parses a duration in one of the following forms:
+//   - Go durations extended with days and weeks: 90s, 1h30m, 1d, 2w3d
+//   - ISO-8601 durations: PT15M, P1DT12H, P2W
+//   - human readable durations: 2 hours, 1 hour and 30 minutes, 3 days, 10 secs
+//
+// A day is always 24 hours and a week is always 7 days.
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("invalid duration: empty string")
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	if len(s) > 1 && (s[0] == 'P' || s[0] == 'p') {
+		return parseISODuration(s)
+	}
+
+	in := []rune(strings.ToLower(s))
+	var total float64
+	units := 0
+	for i := 0; i < len(in); {
+		switch c := in[i]; {
+		case unicode.IsSpace(c) || c == ',':
+			i++
+			continue
+		case c == 'a' && i+2 < len(in) && string(in[i:i+3]) == "and" && units > 0:
+			i += 3
+			continue
+		case !unicode.IsDigit(c) && c != '.':
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		start := i
+		for i < len(in) && (unicode.IsDigit(in[i]) || in[i] == '.') {
+			i++
+		}
+		n, err := strconv.ParseFloat(string(in[start:i]), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		for i < len(in) && unicode.IsSpace(in[i]) {
+			i++
+		}
+		start = i
+		for i < len(in) && unicode.IsLetter(in[i]) {
+			i++
+		}
+		unit, ok := durationUnits[string(in[start:i])]
+		if !ok {
+			if start == i {
+				return 0, fmt.Errorf("invalid duration %q: missing unit", s)
+			}
+			return 0, fmt.Errorf("invalid duration %q: unknown unit %q", s, string(in[start:i]))
+		}
+		total += n * float64(unit)
+		units++
+	}
+	if units == 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	if total > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid duration %q: duration too long", s)
+	}
+	return time.Duration(total), nil
+}
+
+// parseISODuration parses an ISO-8601 duration such as P1DT2H30M.
+// Years and months are rejected since their length varies.
+func parseISODuration(s string) (time.Duration, error) {
+	in := strings.ToUpper(s[1:])
+	var total float64
+	inTime := false
+	units := 0
+	for len(in) > 0 {
+		if in[0] == 'T' {
+			if inTime {
+				return 0, fmt.Errorf("invalid ISO-8601 duration %q", s)
+			}
+			inTime = true
+			in = in[1:]
+			continue
+		}
+		i := strings.IndexFunc(in, func(c rune) bool {
+			return !unicode.IsDigit(c) && c != '.' && c != ','
+		})
+		if i <= 0 {
+			return 0, fmt.Errorf("invalid ISO-8601 duration %q", s)
+		}
+		n, err := strconv.ParseFloat(strings.Replace(in[:i], ",", ".", 1), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid ISO-8601 duration %q", s)
+		}
+		var unit time.Duration
+		switch c := in[i]; {
+		case c == 'W' && !inTime:
+			unit = 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			unit = 24 * time.Hour
+		case c == 'H' && inTime:
+			unit = time.Hour
+		case c == 'M' && inTime:
+			unit = time.Minute
+		case c == 'S' && inTime:
+			unit = time.Second
+		case c == 'Y' || c == 'M':
+			return 0, fmt.Errorf("invalid duration %q: years and months are not supported", s)
+		default:
+			return 0, fmt.Errorf("invalid ISO-8601 duration %q", s)
+		}
+		total += n * float64(unit)
+		units++
+		in = in[i+1:]
+	}
+	if units == 0 {
+		return 0, fmt.Errorf("invalid ISO-8601 duration %q", s)
+	}
+	if total > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid duration %q: duration too long", s)
+	}
+	return time.Duration(total), nil
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"github.com/insomnimus/inscript/ast"
 	"github.com/insomnimus/inscript/token"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,16 +22,33 @@ func pnc(format string, args ...interface{}) {
 	panic(fmt.Sprintf(format, args...))
 }
 
-func parseInterval(s string) (time.Duration, error) {
+func (p *Parser) parseInterval(s string) (time.Duration, error) {
 	if s == "" {
 		return 0, nil
 	}
-	d, err := time.ParseDuration(s)
+	d, err := ParseDuration(s)
 	if err != nil {
 		return 0, err
 	}
-	if d < 30*time.Second {
-		return 0, fmt.Errorf("every:= %s: time interval can't be shorter than 30 seconds", s)
+	if d <= 0 {
+		return 0, fmt.Errorf("every:= %s: time interval must be positive", s)
+	}
+	if d < p.minInterval {
+		return 0, fmt.Errorf("every:= %s: time interval can't be shorter than %s", s, p.minInterval)
+	}
+	return d, nil
+}
+
+func parseOffset(key, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s:= %s: the duration can't be negative", key, s)
 	}
 	return d, nil
 }
@@ -48,9 +67,214 @@ func parseTimes(s string) (int, error) {
 	return n, nil
 }
 
+func parseOverlap(s string) (ast.Overlap, error) {
+	switch strings.ToLower(s) {
+	case "skip", "":
+		return ast.OverlapSkip, nil
+	case "queue":
+		return ast.OverlapQueue, nil
+	case "parallel":
+		return ast.OverlapParallel, nil
+	case "replace":
+		return ast.OverlapReplace, nil
+	default:
+		return 0, fmt.Errorf("invalid value for overlap field %q, values must be one of skip, queue, parallel or replace", s)
+	}
+}
+
+func parsePriority(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for priority field %q, the value must be an integer", s)
+	}
+	return n, nil
+}
+
+// parseLimit parses the value of a concurrency limit, "" and 0 mean no limit.
+func parseLimit(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("the value must be a number")
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("the value can't be negative")
+	}
+	return n, nil
+}
+
+// ParseSingleton parses the value of a #<singleton=...> directive.
+// true is the same as exit.
+func ParseSingleton(s string) (ast.Singleton, error) {
+	switch strings.ToLower(s) {
+	case "", "false", "no", "off":
+		return ast.SingletonOff, nil
+	case "true", "yes", "exit":
+		return ast.SingletonExit, nil
+	case "wait":
+		return ast.SingletonWait, nil
+	case "replace":
+		return ast.SingletonReplace, nil
+	default:
+		return 0, fmt.Errorf("invalid singleton mode %q", s)
+	}
+}
+
+// parseRedirects parses the targets of a stdout or stderr field.
+// A '>>' before a target means the file is appended to and a '>' means it's truncated;
+// explicit reports, for every target, whether either was given.
+func parseRedirects(key string, words []string) (rs []ast.Redirect, explicit []bool, err error) {
+	mode := ""
+	for _, w := range words {
+		if w == ">>" || w == ">" {
+			if mode != "" {
+				return nil, nil, fmt.Errorf("invalid value for %s field %q: expected a file after %q, got %q", key, strings.Join(words, " "), mode, w)
+			}
+			mode = w
+			continue
+		}
+		if mode == "" {
+			switch {
+			case strings.HasPrefix(w, ">>"):
+				mode, w = ">>", w[2:]
+			case strings.HasPrefix(w, ">"):
+				mode, w = ">", w[1:]
+			}
+		}
+		rs = append(rs, ast.Redirect{Target: w, Append: mode == ">>"})
+		explicit = append(explicit, mode != "")
+		mode = ""
+	}
+	if mode != "" {
+		return nil, nil, fmt.Errorf("invalid value for %s field %q: expected a file after %q", key, strings.Join(words, " "), mode)
+	}
+	return rs, explicit, nil
+}
+
+func parseTimestamps(s string) (ast.Timestamps, error) {
+	switch strings.ToLower(s) {
+	case "", "false", "no", "off":
+		return ast.TimestampsOff, nil
+	case "true", "yes", "local":
+		return ast.TimestampsLocal, nil
+	case "rfc3339":
+		return ast.TimestampsRFC3339, nil
+	case "elapsed":
+		return ast.TimestampsElapsed, nil
+	default:
+		return 0, fmt.Errorf("invalid value for timestamps field %q, values must be true, false, rfc3339 or elapsed", s)
+	}
+}
+
+// parsePrefix returns the prefix:= of cmd: its name for true or auto, nothing for false, or the text itself.
+func parsePrefix(cmd *ast.Command, s string) string {
+	switch strings.ToLower(s) {
+	case "", "false", "no", "off":
+		return ""
+	case "true", "yes", "auto":
+		return autoPrefix(cmd)
+	default:
+		return s
+	}
+}
+
+// autoPrefix returns the prefix of cmd when it's not given: its name, or the command if it has no name.
+func autoPrefix(cmd *ast.Command) string {
+	if cmd.Name != "" {
+		return cmd.Name
+	}
+	return cmd.Command
+}
+
+// sizeUnits are the units of sizes given to rotate:=.
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kib": 1 << 10,
+	"kb":  1000,
+	"m":   1 << 20,
+	"mib": 1 << 20,
+	"mb":  1000 * 1000,
+	"g":   1 << 30,
+	"gib": 1 << 30,
+	"gb":  1000 * 1000 * 1000,
+}
+
+// parseRotate parses the value of rotate:=: a size such as 10MB, daily, or both.
+func parseRotate(words []string) (r ast.Rotation, err error) {
+	for _, w := range words {
+		if strings.EqualFold(w, "daily") {
+			r.Daily = true
+			continue
+		}
+		i := strings.IndexFunc(w, func(c rune) bool {
+			return (c < '0' || c > '9') && c != '.'
+		})
+		if i < 0 {
+			i = len(w)
+		}
+		unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(w[i:]))]
+		n, err := strconv.ParseFloat(w[:i], 64)
+		if !ok || err != nil || n <= 0 {
+			return r, fmt.Errorf("invalid value for rotate field %q, expected a size such as 10MB or daily", w)
+		}
+		r.Size = int64(n * float64(unit))
+	}
+	return r, nil
+}
+
+func parseCompress(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "gzip", "gz", "true", "yes":
+		return true, nil
+	case "", "false", "no", "none":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid value for compress field %q, values must be gzip or none", s)
+	}
+}
+
+func parseBool(key, s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes", "true":
+		return true, nil
+	case "false", "no", "":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean value for %s field %q", key, s)
+	}
+}
+
+func parseFileMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0777 {
+		return 0, fmt.Errorf("invalid value for filemode field %q, the value must be an octal permission such as 0644", s)
+	}
+	return os.FileMode(n), nil
+}
+
 type field struct {
-	key string
-	val string
+	key  string
+	val  string
+	line int
+	// the words val is made of
+	vals []string
+	// val is the text of a here-document
+	heredoc bool
+}
+
+// wrap adds the line of the field to err.
+func (f field) wrap(err error) error {
+	return fmt.Errorf("line %d: %w", f.line, err)
 }
 
 func (p *Parser) expect(t token.TokenType) error {
@@ -123,13 +347,86 @@ func (p *Parser) applyDirectives(cmd *ast.Command, set map[string]struct{}) {
 			cmd.Sync = false
 		}
 	}
+	if _, ok := set["prefix"]; !ok && p.prefix {
+		cmd.Prefix = autoPrefix(cmd)
+	}
 	if _, ok := set["stdin"]; !ok && p.stdin != "" {
 		cmd.Stdin = p.stdin
 	}
-	if _, ok := set["stdout"]; !ok && p.stdout != "" {
-		cmd.Stdout = p.stdout
+	if _, ok := set["stdout"]; !ok && p.stdout != nil {
+		cmd.Stdout = append([]ast.Redirect(nil), p.stdout...)
+	}
+	if _, ok := set["stderr"]; !ok && p.stderr != nil {
+		cmd.Stderr = append([]ast.Redirect(nil), p.stderr...)
+	}
+}
+
+// fieldNames are the fields of command blocks.
+var fieldNames = []string{
+	"name", "stdin", "input", "stdout", "stderr", "append", "mkdir", "filemode",
+	"times", "sync", "rotate", "keep", "compress", "prefix", "timestamps", "every",
+	"dir", "workingdirectory", "jitter", "splay", "pool", "priority", "lock", "lockfile", "overlap",
+}
+
+// directiveNames are the keys of #<key=value> directives, except pool directives.
+var directiveNames = []string{
+	"maxparallel", "dir", "workingdirectory", "sync", "prefix", "singleton", "mininterval",
+	"stdin", "stdout", "stderr",
+}
+
+// FieldNames returns the names of the fields of command blocks.
+func FieldNames() []string {
+	return append([]string(nil), fieldNames...)
+}
+
+// DirectiveNames returns the keys of #<key=value> directives, except pool directives.
+func DirectiveNames() []string {
+	return append([]string(nil), directiveNames...)
+}
+
+// suggest returns ", did you mean X?" for the name in names closest to s,
+// or "" if none is close enough to be a likely typo.
+func suggest(s string, names []string) string {
+	s = strings.ToLower(s)
+	best, dist := "", len(s)/3+1
+	for _, name := range names {
+		if d := levenshtein(s, name); d <= dist && (best == "" || d < dist) {
+			best, dist = name, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
 	}
-	if _, ok := set["stderr"]; !ok && p.stderr != "" {
-		cmd.Stderr = p.stderr
+	return prev[len(rb)]
+}
+
+func minInt(n int, rest ...int) int {
+	for _, m := range rest {
+		if m < n {
+			n = m
+		}
 	}
+	return n
 }
@@ -7,19 +7,31 @@ import (
 	"github.com/insomnimus/inscript/token"
 	"os"
 	"strings"
+	"time"
 )
 
+// DefaultMinInterval is the shortest interval allowed in every:= fields,
+// unless changed with a #<mininterval=...> directive or Parser.SetMinInterval.
+const DefaultMinInterval = 30 * time.Second
+
 type Parser struct {
 	l                 *lexer.Lexer
 	prev, token, peek token.Token
 
 	// parsed directives
-	stdin, stdout, stderr, dir, sync string
+	stdin, dir, sync string
+	stdout, stderr   []ast.Redirect
+	prefix           bool
+	minInterval      time.Duration
+	minIntervalFixed bool
+	settings         ast.Settings
+	vars             []ast.Variable
 }
 
 func New(l *lexer.Lexer) (*Parser, error) {
 	p := &Parser{
-		l: l,
+		l:           l,
+		minInterval: DefaultMinInterval,
 	}
 	err := p.read()
 	if err != nil {
@@ -29,6 +41,87 @@ func New(l *lexer.Lexer) (*Parser, error) {
 	return p, err
 }
 
+// SetMinInterval sets the shortest interval allowed in every:= fields.
+// It takes precedence over any #<mininterval=...> directive in the script.
+func (p *Parser) SetMinInterval(d time.Duration) {
+	p.minInterval = d
+	p.minIntervalFixed = true
+}
+
+// Settings returns the script-wide settings set by the directives parsed so far.
+func (p *Parser) Settings() ast.Settings {
+	return p.settings
+}
+
+// Variables returns the variable assignments parsed so far.
+func (p *Parser) Variables() []ast.Variable {
+	return p.vars
+}
+
+// Program parses the rest of the script and returns the whole of it.
+func (p *Parser) Program() (*ast.Program, error) {
+	commands := []*ast.Command{}
+	for cmd, err := p.Next(); err != &ErrEOF; cmd, err = p.Next() {
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, cmd)
+	}
+	return &ast.Program{
+		Settings:  p.settings,
+		Variables: append([]ast.Variable{}, p.vars...),
+		Commands:  commands,
+	}, nil
+}
+
+// Field is a field of a command given as its words rather than as source text, such as the ones of job files.
+type Field struct {
+	Key    string
+	Values []string
+	Line   int
+}
+
+// NewStructured returns a parser for programs that aren't read from source text, such as job files.
+// Directives are set with SetDirective and commands built with Command.
+func NewStructured() *Parser {
+	return &Parser{minInterval: DefaultMinInterval}
+}
+
+// SetDirective sets the directive key to val, as #<key=val> on the given line would.
+func (p *Parser) SetDirective(key, val string, line int) error {
+	return p.checkForDirective(token.Token{Literal: "<" + key + "=" + val + ">", Line: line})
+}
+
+// Command builds the command with the given fields, validating them as the fields of a command block,
+// and applies the directives set so far to it.
+// Unlike in scripts, prefixes such as ':' in the command are taken literally.
+func (p *Parser) Command(command string, args []string, fields []Field, line int) (*ast.Command, error) {
+	cmd := &ast.Command{
+		Command: command,
+		Args:    args,
+		Line:    line,
+	}
+	fs := make([]field, len(fields))
+	for i, f := range fields {
+		fs[i] = field{key: f.Key, val: strings.Join(f.Values, " "), vals: f.Values, line: f.Line}
+	}
+	setFields, err := p.applyFields(cmd, fs)
+	if err != nil {
+		return nil, err
+	}
+	p.applyDirectives(cmd, setFields)
+	return cmd, nil
+}
+
+// Parse parses the whole script l reads.
+func Parse(l *lexer.Lexer) (*ast.Program, error) {
+	p, err := New(l)
+	if err != nil {
+		return nil, err
+	}
+	return p.Program()
+}
+
 func (p *Parser) Next() (*ast.Command, error) {
 	err := p.skipLF()
 	if err != nil {
@@ -77,6 +170,7 @@ func (p *Parser) parseInlineCommand() (*ast.Command, error) {
 
 	cmd := &ast.Command{
 		Command: p.token.Literal,
+		Line:    p.token.Line,
 	}
 	setFields := make(map[string]struct{})
 FOR:
@@ -88,8 +182,8 @@ FOR:
 		case '!':
 			setFields["stderr"] = struct{}{}
 			setFields["stdout"] = struct{}{}
-			cmd.Stderr = "!stderr"
-			cmd.Stdout = "!stdout"
+			cmd.Stderr = []ast.Redirect{{Target: "!stderr"}}
+			cmd.Stdout = []ast.Redirect{{Target: "!stdout"}}
 		case '+':
 			setFields["stdin"] = struct{}{}
 			cmd.Stdin = "!stdin"
@@ -120,12 +214,14 @@ func (p *Parser) parseCommand() (*ast.Command, error) {
 	if p.token.Type != token.At {
 		pnc("internal error: p.parseCommand called on token %s, expected %s instead.", p.token.Type, token.At)
 	}
+	line := p.token.Line
 	err := p.expect(token.String)
 	if err != nil {
 		return nil, err
 	}
 	cmd := &ast.Command{
 		Command: p.token.Literal,
+		Line:    line,
 	}
 	err = p.read()
 	if err != nil {
@@ -175,7 +271,7 @@ LOOP:
 			continue LOOP
 		case token.LF:
 		case token.EOF:
-			return nil, fmt.Errorf("unexpected end of file in command block")
+			return nil, fmt.Errorf("line %d: unexpected end of file in command block", line)
 		default:
 			return nil, fmt.Errorf("line %d: unexpected token of type %s in command block", p.token.Line, p.token.Type)
 		}
@@ -184,27 +280,106 @@ LOOP:
 			return nil, err
 		}
 	}
+	setFields, err := p.applyFields(cmd, fields)
+	if err != nil {
+		return nil, err
+	}
+FOR:
+	for i, c := range cmd.Command {
+		switch c {
+		case ':':
+			if _, ok := setFields["sync"]; !ok {
+				setFields["sync"] = struct{}{}
+				cmd.Sync = true
+			}
+		case '!':
+			if _, ok := setFields["stderr"]; !ok {
+				setFields["stderr"] = struct{}{}
+				cmd.Stderr = []ast.Redirect{{Target: "!stderr"}}
+			}
+			if _, ok := setFields["stdout"]; !ok {
+				setFields["stdout"] = struct{}{}
+				cmd.Stdout = []ast.Redirect{{Target: "!stdout"}}
+			}
+		case '+':
+			if _, ok := setFields["stdin"]; !ok {
+				setFields["stdin"] = struct{}{}
+				cmd.Stdin = "!stdin"
+			}
+		default:
+			cmd.Command = cmd.Command[i:]
+			break FOR
+		}
+	}
+	p.applyDirectives(cmd, setFields)
+
+	return cmd, err
+}
+
+// applyFields sets the fields of a command block on cmd and returns the set of fields it set.
+func (p *Parser) applyFields(cmd *ast.Command, fields []field) (map[string]struct{}, error) {
+	var err error
 	setFields := make(map[string]struct{})
+	var (
+		appendAll                      bool
+		stdoutExplicit, stderrExplicit []bool
+		prefix                         string
+	)
 
 	for _, f := range fields {
-		switch strings.ToLower(f.key) {
+		key := strings.ToLower(f.key)
+		if f.heredoc && key != "stdin" && key != "input" {
+			return nil, f.wrap(fmt.Errorf("a here-document can't be used for the %s field", f.key))
+		}
+		switch key {
 		case "name":
 			setFields["name"] = struct{}{}
 			cmd.Name = f.val
 		case "stdin":
 			setFields["stdin"] = struct{}{}
-			cmd.Stdin = f.val
+			if f.heredoc {
+				cmd.Input = f.val
+			} else {
+				cmd.Stdin = f.val
+			}
+		case "input":
+			setFields["stdin"] = struct{}{}
+			cmd.Input = f.val
 		case "stdout":
 			setFields["stdout"] = struct{}{}
-			cmd.Stdout = f.val
+			cmd.Stdout, stdoutExplicit, err = parseRedirects(f.key, f.vals)
+			if err != nil {
+				return nil, f.wrap(err)
+			}
 		case "stderr":
 			setFields["stderr"] = struct{}{}
-			cmd.Stderr = f.val
+			cmd.Stderr, stderrExplicit, err = parseRedirects(f.key, f.vals)
+			if err != nil {
+				return nil, f.wrap(err)
+			}
+		case "append":
+			setFields["append"] = struct{}{}
+			appendAll, err = parseBool(f.key, f.val)
+			if err != nil {
+				return nil, f.wrap(err)
+			}
+		case "mkdir":
+			setFields["mkdir"] = struct{}{}
+			cmd.Mkdir, err = parseBool(f.key, f.val)
+			if err != nil {
+				return nil, f.wrap(err)
+			}
+		case "filemode":
+			setFields["filemode"] = struct{}{}
+			cmd.FileMode, err = parseFileMode(f.val)
+			if err != nil {
+				return nil, f.wrap(err)
+			}
 		case "times":
 			setFields["times"] = struct{}{}
 			cmd.Times, err = parseTimes(f.val)
 			if err != nil {
-				return nil, err
+				return nil, f.wrap(err)
 			}
 		case "sync":
 			setFields["sync"] = struct{}{}
@@ -213,51 +388,100 @@ LOOP:
 				cmd.Sync = true
 			case "false", "no", "":
 			default:
-				return nil, fmt.Errorf("invalid boolean value for sync field %q", f.val)
+				return nil, f.wrap(fmt.Errorf("invalid boolean value for sync field %q", f.val))
+			}
+		case "rotate":
+			setFields["rotate"] = struct{}{}
+			r, err := parseRotate(f.vals)
+			if err != nil {
+				return nil, f.wrap(err)
+			}
+			cmd.Rotate.Size, cmd.Rotate.Daily = r.Size, r.Daily
+		case "keep":
+			setFields["keep"] = struct{}{}
+			cmd.Rotate.Keep, err = parseLimit(f.val)
+			if err != nil {
+				return nil, f.wrap(fmt.Errorf("invalid value for keep field %q: %w", f.val, err))
+			}
+		case "compress":
+			setFields["compress"] = struct{}{}
+			cmd.Rotate.Compress, err = parseCompress(f.val)
+			if err != nil {
+				return nil, f.wrap(err)
+			}
+		case "prefix":
+			setFields["prefix"] = struct{}{}
+			prefix = f.val
+		case "timestamps":
+			setFields["timestamps"] = struct{}{}
+			cmd.Timestamps, err = parseTimestamps(f.val)
+			if err != nil {
+				return nil, f.wrap(err)
 			}
 		case "every":
 			setFields["every"] = struct{}{}
-			cmd.Every, err = parseInterval(f.val)
+			cmd.Every, err = p.parseInterval(f.val)
 			if err != nil {
-				return nil, err
+				return nil, f.wrap(err)
 			}
 		case "dir", "workingdirectory":
 			setFields["dir"] = struct{}{}
 			cmd.Dir = f.val
-		default:
-			return nil, fmt.Errorf("unknown field %q in command block", f.key)
-		}
-	}
-FOR:
-	for i, c := range cmd.Command {
-		switch c {
-		case ':':
-			if _, ok := setFields["sync"]; !ok {
-				setFields["sync"] = struct{}{}
-				cmd.Sync = true
+		case "jitter":
+			setFields["jitter"] = struct{}{}
+			cmd.Jitter, err = parseOffset(f.key, f.val)
+			if err != nil {
+				return nil, f.wrap(err)
 			}
-		case '!':
-			if _, ok := setFields["stderr"]; !ok {
-				setFields["stderr"] = struct{}{}
-				cmd.Stderr = "!stderr"
+		case "splay":
+			setFields["splay"] = struct{}{}
+			cmd.Splay, err = parseOffset(f.key, f.val)
+			if err != nil {
+				return nil, f.wrap(err)
 			}
-			if _, ok := setFields["stdout"]; !ok {
-				setFields["stdout"] = struct{}{}
-				cmd.Stdout = "!stdout"
+		case "pool":
+			setFields["pool"] = struct{}{}
+			cmd.Pool = f.val
+		case "priority":
+			setFields["priority"] = struct{}{}
+			cmd.Priority, err = parsePriority(f.val)
+			if err != nil {
+				return nil, f.wrap(err)
 			}
-		case '+':
-			if _, ok := setFields["stdin"]; !ok {
-				setFields["stdin"] = struct{}{}
-				cmd.Stdin = "!stdin"
+		case "lock":
+			setFields["lock"] = struct{}{}
+			cmd.Lock = f.val
+		case "lockfile":
+			setFields["lockfile"] = struct{}{}
+			cmd.LockFile = f.val
+		case "overlap":
+			setFields["overlap"] = struct{}{}
+			cmd.Overlap, err = parseOverlap(f.val)
+			if err != nil {
+				return nil, f.wrap(err)
 			}
 		default:
-			cmd.Command = cmd.Command[i:]
-			break FOR
+			return nil, f.wrap(fmt.Errorf("unknown field %q in command block%s", f.key, suggest(key, fieldNames)))
 		}
 	}
-	p.applyDirectives(cmd, setFields)
-
-	return cmd, err
+	if !cmd.Rotate.Enabled() && (cmd.Rotate.Keep > 0 || cmd.Rotate.Compress) {
+		return nil, fmt.Errorf("line %d: command %s: keep:= and compress:= need rotate:=", cmd.Line, cmd.Command)
+	}
+	// the name may come after prefix:=
+	cmd.Prefix = parsePrefix(cmd, prefix)
+	if cmd.Stdin != "" && cmd.Input != "" {
+		return nil, fmt.Errorf("line %d: command %s: the input of a command can't be both a file and text", cmd.Line, cmd.Command)
+	}
+	// append:= applies to the redirects without an explicit '>' or '>>'
+	if appendAll {
+		for i := range cmd.Stdout {
+			cmd.Stdout[i].Append = cmd.Stdout[i].Append || !stdoutExplicit[i]
+		}
+		for i := range cmd.Stderr {
+			cmd.Stderr[i].Append = cmd.Stderr[i].Append || !stderrExplicit[i]
+		}
+	}
+	return setFields, nil
 }
 
 // reads only related tokens
@@ -267,6 +491,7 @@ func (p *Parser) parseField() (f field, err error) {
 		pnc("internal error: p.parseField called with token type %s, expected %s instead.", p.token.Type, token.String)
 	}
 	f.key = p.token.Literal
+	f.line = p.token.Line
 	err = p.expect(token.Assign)
 	if err != nil {
 		return
@@ -275,9 +500,23 @@ func (p *Parser) parseField() (f field, err error) {
 	if err != nil {
 		return
 	}
+	if p.token.Type == token.Heredoc {
+		f.val = p.token.Literal
+		f.heredoc = true
+		err = p.read()
+		return
+	}
 	// read and concat the rest
 	var fields []string
-	for p.token.Type == token.String {
+	for p.token.Type == token.String || p.token.Type == token.At {
+		// a reference to a job, such as stdin:= @producer
+		if p.token.Type == token.At {
+			err = p.expect(token.String)
+			if err != nil {
+				return
+			}
+			p.token.Literal = "@" + p.token.Literal
+		}
 		fields = append(fields, p.token.Literal)
 		err = p.read()
 		if err != nil {
@@ -285,6 +524,7 @@ func (p *Parser) parseField() (f field, err error) {
 		}
 	}
 	f.val = strings.Join(fields, " ")
+	f.vals = fields
 	return
 }
 
@@ -299,7 +539,24 @@ func (p *Parser) checkForDirective(t token.Token) (err error) {
 	split := strings.SplitN(comment, "=", 2)
 	key := split[0]
 	val := split[1]
+	if words := strings.Fields(key); len(words) == 2 && strings.ToLower(words[0]) == "pool" {
+		n, err := parseLimit(val)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid value %q for 'pool %s' directive: %w", t.Line, val, words[1], err)
+		}
+		if p.settings.Pools == nil {
+			p.settings.Pools = make(map[string]int)
+		}
+		p.settings.Pools[words[1]] = n
+		return nil
+	}
 	switch strings.ToLower(key) {
+	case "maxparallel":
+		n, err := parseLimit(val)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid value %q for 'maxparallel' directive: %w", t.Line, val, err)
+		}
+		p.settings.MaxParallel = n
 	case "dir", "workingdirectory":
 		p.dir = val
 	case "sync":
@@ -313,14 +570,49 @@ func (p *Parser) checkForDirective(t token.Token) (err error) {
 		default:
 			return fmt.Errorf("line %d: invalid value %q for 'sync' directive, values must be true or false", t.Line, val)
 		}
+	case "prefix":
+		switch strings.ToLower(val) {
+		case "auto", "true", "yes":
+			p.prefix = true
+		case "", "false", "no", "off":
+			p.prefix = false
+		default:
+			return fmt.Errorf("line %d: invalid value %q for 'prefix' directive, values must be auto or off", t.Line, val)
+		}
+	case "singleton":
+		mode, err := ParseSingleton(val)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid value %q for 'singleton' directive, values must be true, false, exit, wait or replace", t.Line, val)
+		}
+		p.settings.Singleton = mode
+	case "mininterval":
+		if p.minIntervalFixed {
+			break
+		}
+		if val == "" {
+			p.minInterval = DefaultMinInterval
+			break
+		}
+		d, err := ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid value for 'mininterval' directive: %w", t.Line, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("line %d: invalid value %q for 'mininterval' directive, the interval can't be negative", t.Line, val)
+		}
+		p.minInterval = d
 	case "stdin":
 		p.stdin = val
 	case "stdout":
-		p.stdout = val
+		if p.stdout, _, err = parseRedirects("stdout", strings.Fields(val)); err != nil {
+			return fmt.Errorf("line %d: invalid value %q for 'stdout' directive, expected a list of files", t.Line, val)
+		}
 	case "stderr":
-		p.stderr = val
+		if p.stderr, _, err = parseRedirects("stderr", strings.Fields(val)); err != nil {
+			return fmt.Errorf("line %d: invalid value %q for 'stderr' directive, expected a list of files", t.Line, val)
+		}
 	default:
-		return fmt.Errorf("line %d: unrecognized directive: %s", t.Line, t.Literal)
+		return fmt.Errorf("line %d: unrecognized directive: %s%s", t.Line, t.Literal, suggest(key, directiveNames))
 	}
 	return
 }
@@ -335,6 +627,7 @@ func (p *Parser) parseVariable() error {
 		pnc("internal error: line %d: p.parseVariable called on peek %s token, expected %s instead", p.peek.Line, p.peek.Type, token.Assign)
 	}
 	key := p.token.Literal
+	line := p.token.Line
 	err := p.read()
 	if err != nil {
 		return err
@@ -355,5 +648,18 @@ func (p *Parser) parseVariable() error {
 	default:
 		return fmt.Errorf("line %d: can't assign %s to a variable, the value has to be a string", p.token.Line, p.token.Literal)
 	}
+	p.vars = append(p.vars, ast.Variable{Name: key, Value: val, Line: line})
 	return os.Setenv(key, val)
 }
+
+// RestoreEnv replaces the environment with env, as returned by os.Environ.
+// Parsing sets the variables of a script in the environment;
+// saving it first and restoring it after keeps them from leaking into what's parsed next.
+func RestoreEnv(env []string) {
+	os.Clearenv()
+	for _, kv := range env {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			os.Setenv(kv[:i], kv[i+1:])
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package parser
 
 import (
+	"encoding/json"
 	"github.com/insomnimus/inscript/ast"
 	"github.com/insomnimus/inscript/lexer"
+	"strings"
 	"testing"
 	"time"
 )
@@ -17,6 +19,9 @@ x:=42
 	sync:= true
 	stdout:= cat.out
 	every:= 1h
+	overlap:= queue
+	jitter:= 5m
+	splay:= 1 hour
 }
 
 bash -c 'echo hello'
@@ -41,17 +46,20 @@ sed
 			Command: "cat",
 			Args:    []string{"go.mod"},
 			Sync:    true,
-			Stdout:  "cat.out",
+			Stdout:  []ast.Redirect{{Target: "cat.out"}},
 			Every:   time.Hour,
+			Overlap: ast.OverlapQueue,
+			Jitter:  5 * time.Minute,
+			Splay:   time.Hour,
 		}, {
 			Command: "bash",
 			Args:    []string{"-c", "echo hello"},
 		}, {
 			Command: "echo",
 			Args:    []string{"42"},
-			Stdout:  "!stdout",
+			Stdout:  []ast.Redirect{{Target: "!stdout"}},
 			Stdin:   "!stdin",
-			Stderr:  "!stderr",
+			Stderr:  []ast.Redirect{{Target: "!stderr"}},
 			Sync:    true,
 		}, {
 			Command: "ls",
@@ -81,3 +89,421 @@ sed
 		}
 	}
 }
+
+func TestParseDuration(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		in  string
+		out time.Duration
+	}{
+		{"30s", 30 * time.Second},
+		{"1h30m", 90 * time.Minute},
+		{"1d", day},
+		{"1w", 7 * day},
+		{"2w3d", 17 * day},
+		{"1d12h", 36 * time.Hour},
+		{"PT15M", 15 * time.Minute},
+		{"P1DT12H", 36 * time.Hour},
+		{"pt0.5s", 500 * time.Millisecond},
+		{"P2W", 14 * day},
+		{"2 hours", 2 * time.Hour},
+		{"1 hour and 30 minutes", 90 * time.Minute},
+		{"1 Day, 2 Hours", 26 * time.Hour},
+		{"10 secs", 10 * time.Second},
+		{"1.5 weeks", 252 * time.Hour},
+	}
+	for _, test := range tests {
+		d, err := ParseDuration(test.in)
+		if err != nil {
+			t.Errorf("ParseDuration(%q) returned error: %s", test.in, err)
+			continue
+		}
+		if d != test.out {
+			t.Errorf("ParseDuration(%q): expected %s, got %s", test.in, test.out, d)
+		}
+	}
+
+	for _, s := range []string{"", "5", "hours", "2 fortnights", "P1M", "P1Y", "PT", "P1H"} {
+		if d, err := ParseDuration(s); err == nil {
+			t.Errorf("ParseDuration(%q): expected an error, got %s", s, d)
+		}
+	}
+}
+
+func TestMinInterval(t *testing.T) {
+	input := `@ echo a {
+	every:= 5s
+}
+`
+	p, err := New(lexer.New(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.Next(); err == nil {
+		t.Errorf("expected an error for an interval shorter than %s", DefaultMinInterval)
+	}
+
+	p, err = New(lexer.New("#<mininterval=1s>\n" + input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := p.Next()
+	if err != nil {
+		t.Fatalf("p.Next returned error: %s", err)
+	}
+	if cmd.Every != 5*time.Second {
+		t.Errorf("expected every to be 5s, got %s", cmd.Every)
+	}
+
+	p, err = New(lexer.New("#<mininterval=1s>\n" + input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetMinInterval(time.Minute)
+	if _, err = p.Next(); err == nil {
+		t.Errorf("expected SetMinInterval to take precedence over the directive")
+	}
+}
+
+func TestSettings(t *testing.T) {
+	input := `#<maxparallel=4>
+#<singleton=wait>
+#<pool db=2>
+#<pool net=1>
+@ psql -f a.sql {
+	pool:= db
+	priority:= 10
+	lock:= migrations
+	lockfile:= /tmp/migrations.lock
+}
+`
+	p, err := New(lexer.New(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := p.Next()
+	if err != nil {
+		t.Fatalf("p.Next returned error: %s", err)
+	}
+	if cmd.Pool != "db" || cmd.Priority != 10 {
+		t.Errorf("expected pool db and priority 10, got %#v", cmd)
+	}
+	if cmd.Lock != "migrations" || cmd.LockFile != "/tmp/migrations.lock" {
+		t.Errorf("expected lock migrations and lock file /tmp/migrations.lock, got %#v", cmd)
+	}
+	s := p.Settings()
+	if s.MaxParallel != 4 || s.Pools["db"] != 2 || s.Pools["net"] != 1 || s.Singleton != ast.SingletonWait {
+		t.Errorf("unexpected settings: %+v", s)
+	}
+}
+
+func TestRedirectModes(t *testing.T) {
+	input := `@ make {
+	stdout:= >> build.log
+	stderr:= errors.log
+}
+@ make {
+	stdout:= > build.log
+	stderr:= errors.log
+	append:= true
+	filemode:= 0600
+}
+#<stdout=>>all.log>
+echo
+@ make {
+	stdout:= !stdout build.log >> all.log
+	stderr:= >errors.log !stderr
+	append:= true
+}
+`
+	tests := []*ast.Command{
+		{Command: "make", Stdout: []ast.Redirect{{Target: "build.log", Append: true}}, Stderr: []ast.Redirect{{Target: "errors.log"}}},
+		{Command: "make", Stdout: []ast.Redirect{{Target: "build.log"}}, Stderr: []ast.Redirect{{Target: "errors.log", Append: true}}, FileMode: 0600},
+		{Command: "echo", Stdout: []ast.Redirect{{Target: "all.log", Append: true}}},
+		{
+			Command: "make",
+			Stdout:  []ast.Redirect{{Target: "!stdout", Append: true}, {Target: "build.log", Append: true}, {Target: "all.log", Append: true}},
+			Stderr:  []ast.Redirect{{Target: "errors.log"}, {Target: "!stderr", Append: true}},
+		},
+	}
+	p, err := New(lexer.New(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		cmd, err := p.Next()
+		if err != nil {
+			t.Fatalf("p.Next returned error: %s", err)
+		}
+		if !test.Equal(*cmd) {
+			t.Errorf("command mismatch:\nexpected %#v\ngot %#v\n", test, cmd)
+		}
+	}
+}
+
+func TestRedirectErrors(t *testing.T) {
+	for _, input := range []string{
+		"@ make {\n\tstdout:= build.log >\n}\n",
+		"@ make {\n\tstdout:= > >> build.log\n}\n",
+		"#<stderr=errors.log >>>\nmake\n",
+	} {
+		p, err := New(lexer.New(input))
+		if err == nil {
+			_, err = p.Next()
+		}
+		if err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+}
+
+func TestInput(t *testing.T) {
+	input := `@ psql {
+	stdin:= <<-SQL
+		select 1;
+		select 2;
+	SQL
+	name:= query
+}
+@ cat {
+	input:= "some text"
+}
+cat <<EOF
+`
+	tests := []*ast.Command{
+		{Command: "psql", Name: "query", Input: "select 1;\nselect 2;\n"},
+		{Command: "cat", Input: "some text"},
+		// only the value of a field is a here-document
+		{Command: "cat", Args: []string{"<<EOF"}},
+	}
+	p, err := New(lexer.New(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		cmd, err := p.Next()
+		if err != nil {
+			t.Fatalf("p.Next returned error: %s", err)
+		}
+		if !test.Equal(*cmd) {
+			t.Errorf("command mismatch:\nexpected %#v\ngot %#v\n", test, cmd)
+		}
+	}
+
+	for _, input := range []string{
+		"@ cat {\n\tstdin:= in.txt\n\tinput:= text\n}\n",
+		"@ cat {\n\tname:= <<EOF\nx\nEOF\n}\n",
+	} {
+		p, err := New(lexer.New(input))
+		if err == nil {
+			_, err = p.Next()
+		}
+		if err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+}
+
+func TestJobRefs(t *testing.T) {
+	input := `@ cat {
+	stdin:= @producer
+}
+@ tail -f app.log {
+	name:= producer
+	stdout:= !stdout @consumer
+}
+`
+	tests := []*ast.Command{
+		{Command: "cat", Stdin: "@producer"},
+		{Command: "tail", Args: []string{"-f", "app.log"}, Name: "producer", Stdout: []ast.Redirect{{Target: "!stdout"}, {Target: "@consumer"}}},
+	}
+	p, err := New(lexer.New(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		cmd, err := p.Next()
+		if err != nil {
+			t.Fatalf("p.Next returned error: %s", err)
+		}
+		if !test.Equal(*cmd) {
+			t.Errorf("command mismatch:\nexpected %#v\ngot %#v\n", test, cmd)
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	input := `@ make build {
+	prefix:= true
+	name:= build
+	timestamps:= rfc3339
+}
+@ make test {
+	prefix:= tests
+	timestamps:= elapsed
+}
+#<prefix=auto>
+echo
+@ echo {
+	name:= quiet
+	prefix:= off
+}
+`
+	tests := []*ast.Command{
+		{Command: "make", Args: []string{"build"}, Name: "build", Prefix: "build", Timestamps: ast.TimestampsRFC3339},
+		{Command: "make", Args: []string{"test"}, Prefix: "tests", Timestamps: ast.TimestampsElapsed},
+		{Command: "echo", Prefix: "echo"},
+		{Command: "echo", Name: "quiet"},
+	}
+	p, err := New(lexer.New(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		cmd, err := p.Next()
+		if err != nil {
+			t.Fatalf("p.Next returned error: %s", err)
+		}
+		if !test.Equal(*cmd) {
+			t.Errorf("command mismatch:\nexpected %#v\ngot %#v\n", test, cmd)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	input := `@ tail -f app.log {
+	stdout:= out.log
+	rotate:= 10MB daily
+	keep:= 5
+	compress:= gzip
+}
+@ echo {
+	rotate:= 1.5KiB
+}
+`
+	tests := []*ast.Command{
+		{Command: "tail", Args: []string{"-f", "app.log"}, Stdout: []ast.Redirect{{Target: "out.log"}}, Rotate: ast.Rotation{Size: 10 * 1000 * 1000, Daily: true, Keep: 5, Compress: true}},
+		{Command: "echo", Rotate: ast.Rotation{Size: 1536}},
+	}
+	p, err := New(lexer.New(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		cmd, err := p.Next()
+		if err != nil {
+			t.Fatalf("p.Next returned error: %s", err)
+		}
+		if !test.Equal(*cmd) {
+			t.Errorf("command mismatch:\nexpected %#v\ngot %#v\n", test, cmd)
+		}
+	}
+
+	for _, input := range []string{
+		"@ echo {\n\trotate:= 10XB\n}\n",
+		"@ echo {\n\trotate:= weekly\n}\n",
+		"@ echo {\n\tkeep:= 5\n}\n",
+		"@ echo {\n\trotate:= daily\n\tcompress:= zip\n}\n",
+	} {
+		p, err := New(lexer.New(input))
+		if err == nil {
+			_, err = p.Next()
+		}
+		if err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	input := `@ make {
+	stdout:= logs/{{.Name}}-{{.Iter}}-{{.Time "20060102T150405"}}.log
+	dir:= builds/{{.Iter}}
+}
+`
+	want := &ast.Command{
+		Command: "make",
+		Dir:     "builds/{{.Iter}}",
+		Stdout:  []ast.Redirect{{Target: `logs/{{.Name}}-{{.Iter}}-{{.Time "20060102T150405"}}.log`}},
+	}
+	p, err := New(lexer.New(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := p.Next()
+	if err != nil {
+		t.Fatalf("p.Next returned error: %s", err)
+	}
+	if !want.Equal(*cmd) {
+		t.Errorf("command mismatch:\nexpected %#v\ngot %#v\n", want, cmd)
+	}
+}
+
+func TestPositionsAndSuggestions(t *testing.T) {
+	input := "x:=1\n\n@ echo $x {\n\tname:= greet\n}\ndate\n"
+	p, err := New(lexer.New(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []int
+	for cmd, err := p.Next(); err != &ErrEOF; cmd, err = p.Next() {
+		if err != nil {
+			t.Fatalf("p.Next returned error: %s", err)
+		}
+		lines = append(lines, cmd.Line)
+	}
+	if len(lines) != 2 || lines[0] != 2 || lines[1] != 5 {
+		t.Errorf("expected the commands to start on lines 2 and 5, got %v", lines)
+	}
+	if vars := p.Variables(); len(vars) != 1 || vars[0] != (ast.Variable{Name: "x", Value: "1", Line: 0}) {
+		t.Errorf("expected the variable x on line 0, got %+v", vars)
+	}
+
+	for input, want := range map[string]string{
+		"@ echo {\n\tstdot:= x\n}\n": `line 1: unknown field "stdot" in command block, did you mean "stdout"?`,
+		"@ echo {\n\tbogus:= x\n}\n": `line 1: unknown field "bogus" in command block`,
+		"#<maxparalel=2>\necho\n":    `line 0: unrecognized directive: <maxparalel=2>, did you mean "maxparallel"?`,
+		"#<Singletn=wait>\necho\n":   `line 0: unrecognized directive: <Singletn=wait>, did you mean "singleton"?`,
+	} {
+		p, err := New(lexer.New(input))
+		if err == nil {
+			_, err = p.Next()
+		}
+		if err == nil || err.Error() != want {
+			t.Errorf("expected the error %q for %q, got %v", want, input, err)
+		}
+	}
+}
+
+func TestProgram(t *testing.T) {
+	input := "#<maxparallel=2>\nx:=1\n@ echo $x {\n\tname:= greet\n\tevery:= 90s\n\toverlap:= queue\n\tstdout:= >>out.log\n}\n"
+	prog, err := Parse(lexer.New(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.Settings.MaxParallel != 2 || len(prog.Variables) != 1 || len(prog.Commands) != 1 {
+		t.Fatalf("unexpected program: %+v", prog)
+	}
+
+	data, err := json.Marshal(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"every":"1m30s"`, `"overlap":"queue"`, `"stdout":[{"target":"out.log","append":true}]`, `"line":2`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected %s in the JSON, got %s", want, data)
+		}
+	}
+	var got ast.Program
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Commands) != 1 || !got.Commands[0].Equal(*prog.Commands[0]) || got.Commands[0].Line != 2 ||
+		got.Settings.MaxParallel != 2 || got.Variables[0] != prog.Variables[0] {
+		t.Errorf("the program changed after a JSON round trip: %s", data)
+	}
+
+	if _, err := Parse(lexer.New("@ echo {\n\tbogus:= x\n}\n")); err == nil {
+		t.Error("expected Parse to return the error of an unknown field")
+	}
+}
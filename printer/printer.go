@@ -0,0 +1,137 @@
+// Package printer prints syntax trees of scripts in canonical form.
+package printer
+
+import (
+	"bufio"
+	"github.com/insomnimus/inscript/syntax"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Format returns the script in src in canonical form.
+func Format(src []byte) ([]byte, error) {
+	f, err := syntax.Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+	var buf strings.Builder
+	if err := Fprint(&buf, f); err != nil {
+		return nil, err
+	}
+	return []byte(buf.String()), nil
+}
+
+// Fprint writes f to w in canonical form:
+//   - statements and fields go on lines of their own, fields indented by a tab
+//   - runs of blank lines are shortened to one, and blank lines at the start and end of the file and blocks are removed
+//   - assignments and fields are written as key:= value, field keys in lower case
+//   - words are written in double quotes rather than single quotes or backquotes when that doesn't change them
+//   - comments and here-documents are kept as they are, without trailing space
+func Fprint(w io.Writer, f *syntax.File) error {
+	bw := bufio.NewWriter(w)
+	printNodes(bw, f.Nodes, "")
+	return bw.Flush()
+}
+
+func printNodes(w *bufio.Writer, nodes []syntax.Node, indent string) {
+	nodes = trimBlanks(nodes)
+	for i, n := range nodes {
+		if _, ok := n.(*syntax.Blank); ok {
+			// runs of blank lines are shortened to one
+			if _, prev := nodes[i-1].(*syntax.Blank); !prev {
+				w.WriteByte('\n')
+			}
+			continue
+		}
+		w.WriteString(indent)
+		switch n := n.(type) {
+		case *syntax.Comment:
+			w.WriteString(comment(n))
+		case *syntax.Variable:
+			w.WriteString(n.Name.Raw)
+			w.WriteString(":=")
+			if n.Value != nil {
+				w.WriteByte(' ')
+				w.WriteString(word(*n.Value))
+			}
+			printComment(w, n.Comment)
+		case *syntax.Field:
+			w.WriteString(strings.ToLower(n.Key.Raw))
+			w.WriteString(":=")
+			for _, v := range n.Values {
+				w.WriteByte(' ')
+				if n.Heredoc {
+					w.WriteString(v.Raw)
+				} else {
+					w.WriteString(word(v))
+				}
+			}
+			printComment(w, n.Comment)
+		case *syntax.Command:
+			if n.Block {
+				w.WriteString("@ ")
+			}
+			for i, v := range n.Words {
+				if i > 0 {
+					w.WriteByte(' ')
+				}
+				w.WriteString(word(v))
+			}
+			if n.Block {
+				w.WriteString(" {")
+			}
+			printComment(w, n.Comment)
+			if n.Block {
+				w.WriteByte('\n')
+				printNodes(w, n.Body, indent+"\t")
+				w.WriteString(indent)
+				w.WriteByte('}')
+				printComment(w, n.EndComment)
+			}
+		}
+		w.WriteByte('\n')
+	}
+}
+
+// trimBlanks removes the blank lines at the start and end of nodes.
+func trimBlanks(nodes []syntax.Node) []syntax.Node {
+	for len(nodes) > 0 {
+		if _, ok := nodes[0].(*syntax.Blank); !ok {
+			break
+		}
+		nodes = nodes[1:]
+	}
+	for len(nodes) > 0 {
+		if _, ok := nodes[len(nodes)-1].(*syntax.Blank); !ok {
+			break
+		}
+		nodes = nodes[:len(nodes)-1]
+	}
+	return nodes
+}
+
+func comment(c *syntax.Comment) string {
+	return strings.TrimRightFunc(c.Text, unicode.IsSpace)
+}
+
+// printComment writes the comment at the end of a line, if any.
+func printComment(w *bufio.Writer, c *syntax.Comment) {
+	if c != nil {
+		w.WriteByte(' ')
+		w.WriteString(comment(c))
+	}
+}
+
+// word returns how w is written:
+// single quoted and backquoted words are written in double quotes if nothing in them would be read differently,
+// and the rest as they are.
+func word(w syntax.Word) string {
+	if !strings.HasPrefix(w.Raw, "'") && !strings.HasPrefix(w.Raw, "`") {
+		return w.Raw
+	}
+	if strings.ContainsAny(w.Value, "\"\\$\n") {
+		return w.Raw
+	}
+	return `"` + w.Value + `"`
+}
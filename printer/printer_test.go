@@ -0,0 +1,155 @@
+package printer
+
+import (
+	"github.com/insomnimus/inscript/ast"
+	"github.com/insomnimus/inscript/lexer"
+	"github.com/insomnimus/inscript/parser"
+	"os"
+	"testing"
+)
+
+const messy = `
+
+x :=   42
+name:='world'   # who
+#<sync=true>
+  echo   'hello'  "$name" ` + "`a b`" + `   # greet
+
+
+
+@   cat  "in file.txt" {  # block
+  STDOUT :=  a.log   "b.log"
+	stderr:= @ producer
+
+   input:= <<-END
+	  line one
+	   line two $x
+	END
+	every:=1m
+	prefix:='$(date)'
+
+}  # end
+:sleep 1
+`
+
+const canonical = `x:= 42
+name:= "world" # who
+#<sync=true>
+echo "hello" "$name" "a b" # greet
+
+@ cat "in file.txt" { # block
+	stdout:= a.log "b.log"
+	stderr:= @producer
+
+	input:= <<-END
+	  line one
+	   line two $x
+	END
+	every:= 1m
+	prefix:= '$(date)'
+} # end
+:sleep 1
+`
+
+func TestFormat(t *testing.T) {
+	out, err := Format([]byte(messy))
+	if err != nil {
+		t.Fatalf("Format returned error: %s", err)
+	}
+	if string(out) != canonical {
+		t.Errorf("expected:\n%s\ngot:\n%s", canonical, out)
+	}
+	again, err := Format(out)
+	if err != nil {
+		t.Fatalf("Format returned error on its own output: %s", err)
+	}
+	if string(again) != string(out) {
+		t.Errorf("expected formatting to be idempotent, got:\n%s", again)
+	}
+
+	for _, input := range []string{
+		"@ echo {\n\tstdout:= x\n",
+		"x:= @y\n",
+		"}\n",
+		`echo "unterminated` + "\n",
+	} {
+		if _, err := Format([]byte(input)); err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+}
+
+// TestIdempotent checks that formatting the output of Format again doesn't change it,
+// and that inputs it can't keep as they are, such as an unterminated $(, are rejected instead.
+func TestIdempotent(t *testing.T) {
+	for _, c := range []struct {
+		input string
+		bad   bool
+	}{
+		{messy, false},
+		{"echo $(date)\n", false},
+		{"echo a\\\nb\n", false},
+		{"echo \\", true},
+		{"\"$(:#<<\t1\\%|1", true},
+		{"echo $(date\n", true},
+	} {
+		once, err := Format([]byte(c.input))
+		if c.bad {
+			if err == nil {
+				t.Errorf("expected an error for %q, got %q", c.input, once)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Format returned error for %q: %s", c.input, err)
+			continue
+		}
+		twice, err := Format(once)
+		if err != nil {
+			t.Errorf("Format returned error on its own output %q: %s", once, err)
+			continue
+		}
+		if string(twice) != string(once) {
+			t.Errorf("expected formatting %q twice to give %q, got %q", c.input, once, twice)
+		}
+	}
+}
+
+// TestRoundTrip checks that formatting doesn't change what scripts mean.
+func TestRoundTrip(t *testing.T) {
+	example, err := os.ReadFile("../examples/time.ins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []string{messy, string(example)} {
+		out, err := Format([]byte(src))
+		if err != nil {
+			t.Fatalf("Format returned error: %s", err)
+		}
+		want, got := parse(t, src), parse(t, string(out))
+		if len(want) != len(got) {
+			t.Fatalf("expected %d commands after formatting, got %d", len(want), len(got))
+		}
+		for i := range want {
+			if !want[i].Equal(*got[i]) {
+				t.Errorf("command %d changed by formatting:\nexpected %#v\ngot %#v", i, want[i], got[i])
+			}
+		}
+	}
+}
+
+func parse(t *testing.T, src string) []*ast.Command {
+	t.Helper()
+	p, err := parser.New(lexer.NewMode(src, lexer.NoEval))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmds []*ast.Command
+	for cmd, err := p.Next(); err != &parser.ErrEOF; cmd, err = p.Next() {
+		if err != nil {
+			t.Fatalf("p.Next returned error: %s", err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds
+}
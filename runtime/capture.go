@@ -0,0 +1,41 @@
+package runtime
+
+import (
+	"sync"
+)
+
+// maxCapture is how much of the output of a run is kept by !capture;
+// only the end of longer output is kept.
+const maxCapture = 64 * 1024
+
+// captureTarget stands for the in-memory buffer of a run among the targets of a process.
+// Every run writes to a buffer of its own instead.
+type captureTarget struct{}
+
+func (captureTarget) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// captureBuffer keeps the end of the output of a run in memory.
+// It's safe for concurrent use, since stdout and stderr may both be captured.
+type captureBuffer struct {
+	mux sync.Mutex
+	buf []byte
+}
+
+func (c *captureBuffer) Write(p []byte) (int, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.buf = append(c.buf, p...)
+	if n := len(c.buf) - maxCapture; n > 0 {
+		c.buf = append(c.buf[:0], c.buf[n:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns a copy of what's been captured.
+func (c *captureBuffer) Bytes() []byte {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return append([]byte(nil), c.buf...)
+}
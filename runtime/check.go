@@ -0,0 +1,171 @@
+package runtime
+
+import (
+	"fmt"
+	"github.com/insomnimus/inscript/ast"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Severity is how serious a Diagnostic is.
+type Severity uint8
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// A Diagnostic is a problem found in a script without running it.
+type Diagnostic struct {
+	// Line is the line of the command the problem is about, 0 if it's about the whole script.
+	Line     int      `json:"line"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+// Check reports the problems of cmds that can be found without running anything:
+// the errors DryRun reports, commands that aren't found,
+// jobs that may write the same file at the same time or read a file another job may be writing,
+// and sync:= on jobs that repeat forever, which never finish.
+// Jobs repeating forever always run in the background, so the commands after them are never unreachable;
+// the sync:= true that would make them so is ignored, and that is what's reported instead.
+// The diagnostics are sorted by line.
+func (r *Runner) Check(cmds []*ast.Command) []Diagnostic {
+	var ds []Diagnostic
+	report := func(line int, sev Severity, format string, args ...interface{}) {
+		ds = append(ds, Diagnostic{Line: line, Severity: sev, Message: fmt.Sprintf(format, args...)})
+	}
+	if err := r.DryRun(io.Discard, cmds); err != nil {
+		report(0, SeverityError, "%s", err)
+	}
+
+	type files struct {
+		writes []string
+		reads  string
+	}
+	fs := make([]files, len(cmds))
+	for i, cmd := range cmds {
+		if err := lookCommand(cmd); err != nil {
+			report(cmd.Line, SeverityError, "%s", err)
+		}
+		if cmd.Sync && cmd.Every > 0 && cmd.Times == 0 {
+			report(cmd.Line, SeverityWarning, "%s repeats forever, so it runs in the background despite sync:= true; "+
+				"if it were waited for, the commands after it would never run", jobName(cmd))
+		}
+		for _, rd := range append(append([]ast.Redirect(nil), cmd.Stdout...), cmd.Stderr...) {
+			if path, ok := r.checkPath(cmd, rd.Target); ok {
+				fs[i].writes = append(fs[i].writes, path)
+			}
+		}
+		if path, ok := r.checkPath(cmd, cmd.Stdin); ok {
+			fs[i].reads = path
+		}
+	}
+
+	// a job may run alongside the ones after it unless it's waited for
+	for i, a := range cmds {
+		if !isAsync(a) {
+			continue
+		}
+		for j := i + 1; j < len(cmds); j++ {
+			b := cmds[j]
+			if r.serialized(a, b) {
+				continue
+			}
+			for _, path := range fs[j].writes {
+				if contains(fs[i].writes, path) {
+					report(b.Line, SeverityWarning, "%s and %s (line %d) may write to %s at the same time",
+						jobName(b), jobName(a), a.Line, path)
+				}
+				if fs[i].reads == path {
+					report(b.Line, SeverityWarning, "%s may write to %s while %s (line %d) reads it",
+						jobName(b), path, jobName(a), a.Line)
+				}
+			}
+			if fs[j].reads != "" && contains(fs[i].writes, fs[j].reads) {
+				report(b.Line, SeverityWarning, "%s reads %s, which %s (line %d) may be writing to",
+					jobName(b), fs[j].reads, jobName(a), a.Line)
+			}
+		}
+	}
+	sort.SliceStable(ds, func(i, j int) bool {
+		return ds[i].Line < ds[j].Line
+	})
+	return ds
+}
+
+// checkPath resolves the path of a redirect target of cmd,
+// reporting false if it isn't a file or its path is only known when the command runs.
+func (r *Runner) checkPath(cmd *ast.Command, target string) (string, bool) {
+	if target == "" || strings.HasPrefix(target, "!") || strings.HasPrefix(target, "@") ||
+		isTemplate(target) || isTemplate(cmd.Dir) {
+		return "", false
+	}
+	dir, err := expandHome(cmd.Dir)
+	if err != nil {
+		return "", false
+	}
+	path, err := resolvePath(r.Dir, dir, target)
+	return path, err == nil
+}
+
+// lookCommand reports an error if the program of cmd can't be found.
+// Programs given as a path are looked up relative to the dir:= of cmd.
+func lookCommand(cmd *ast.Command) error {
+	name := cmd.Command
+	// a command substitution left unevaluated
+	if strings.Contains(name, "$(") {
+		return nil
+	}
+	if !strings.ContainsAny(name, `/\`) {
+		if _, err := exec.LookPath(name); err != nil {
+			return fmt.Errorf("%s: command not found in PATH", name)
+		}
+		return nil
+	}
+	path, err := expandHome(name)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(path) && cmd.Dir != "" && !isTemplate(cmd.Dir) {
+		dir, err := expandHome(cmd.Dir)
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(dir, path)
+	}
+	if _, err := exec.LookPath(path); err != nil {
+		return fmt.Errorf("%s: no such executable", name)
+	}
+	return nil
+}
+
+// serialized reports whether a and b can't run at the same time
+// because they share a lock or a pool only one command may run in at once.
+func (r *Runner) serialized(a, b *ast.Command) bool {
+	return (a.Lock != "" && a.Lock == b.Lock) || (a.LockFile != "" && a.LockFile == b.LockFile) ||
+		r.limiter.serializes(a.Pool, b.Pool)
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
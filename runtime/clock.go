@@ -0,0 +1,285 @@
+package runtime
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time the scheduler uses.
+// The default is the system clock; a SimClock lets schedules be simulated.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer of a Clock, behaving like *time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+func (t realTimer) Reset(d time.Duration) bool {
+	return t.t.Reset(d)
+}
+
+// SimClock is a Clock whose time only moves when Step is called.
+// It keeps count of the goroutines of a simulation that are busy,
+// so that Settle can tell when they're all waiting.
+type SimClock struct {
+	mux    sync.Mutex
+	now    time.Time
+	timers []*simTimer
+	busy   int
+	waits  map[*simWait]struct{}
+	// signalled whenever busy goes down
+	idle *sync.Cond
+}
+
+// NewSimClock returns a SimClock starting at start.
+func NewSimClock(start time.Time) *SimClock {
+	c := &SimClock{now: start, waits: make(map[*simWait]struct{})}
+	c.idle = sync.NewCond(&c.mux)
+	return c
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+func (c *SimClock) NewTimer(d time.Duration) Timer {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	t := &simTimer{c: c, ch: make(chan time.Time, 1)}
+	c.schedule(t, d)
+	return t
+}
+
+// schedule arms t to fire after d.
+// c.mux must be held.
+func (c *SimClock) schedule(t *simTimer, d time.Duration) {
+	t.when = c.now.Add(d)
+	t.armed = true
+	c.timers = append(c.timers, t)
+}
+
+// unschedule disarms t, reporting whether it was armed.
+// c.mux must be held.
+func (c *SimClock) unschedule(t *simTimer) bool {
+	if !t.armed {
+		return false
+	}
+	t.armed = false
+	for i, x := range c.timers {
+		if x == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Settle waits until every goroutine of the simulation is waiting,
+// and none of them for something that has already happened.
+// The clock can then be stepped without anyone missing the current time.
+func (c *SimClock) Settle() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for {
+		for w := range c.waits {
+			if !w.woken && w.ready() {
+				w.wake()
+			}
+		}
+		if c.busy == 0 {
+			return
+		}
+		c.idle.Wait()
+	}
+}
+
+// add counts n more goroutines as busy.
+func (c *SimClock) add(n int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.busy += n
+	if n < 0 {
+		c.idle.Broadcast()
+	}
+}
+
+// Next returns when the earliest timer fires, or false if no timer is armed.
+func (c *SimClock) Next() (time.Time, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if len(c.timers) == 0 {
+		return time.Time{}, false
+	}
+	next := c.timers[0].when
+	for _, t := range c.timers[1:] {
+		if t.when.Before(next) {
+			next = t.when
+		}
+	}
+	return next, true
+}
+
+// Step moves the time to t, if it's later, and fires every timer due by then, earliest first.
+func (c *SimClock) Step(t time.Time) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if t.After(c.now) {
+		c.now = t
+	}
+	var due, rest []*simTimer
+	for _, x := range c.timers {
+		if x.when.After(c.now) {
+			rest = append(rest, x)
+		} else {
+			due = append(due, x)
+		}
+	}
+	c.timers = rest
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].when.Before(due[j].when)
+	})
+	for _, x := range due {
+		x.armed = false
+		select {
+		case x.ch <- x.when:
+		default:
+		}
+		for w := range c.waits {
+			if w.timer == x && !w.woken {
+				w.wake()
+			}
+		}
+	}
+}
+
+type simTimer struct {
+	c     *SimClock
+	ch    chan time.Time
+	when  time.Time
+	armed bool
+}
+
+func (t *simTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *simTimer) Stop() bool {
+	t.c.mux.Lock()
+	defer t.c.mux.Unlock()
+	return t.c.unschedule(t)
+}
+
+func (t *simTimer) Reset(d time.Duration) bool {
+	t.c.mux.Lock()
+	defer t.c.mux.Unlock()
+	active := t.c.unschedule(t)
+	t.c.schedule(t, d)
+	return active
+}
+
+// simWait is a goroutine of a simulation waiting for something.
+type simWait struct {
+	c *SimClock
+	// ready reports whether what it waits for, other than timer, has happened.
+	// Once it reports true, it must keep doing so until the wait is done.
+	ready func() bool
+	timer *simTimer
+	// set once it's known the goroutine goes on, from which point it counts as busy again
+	woken bool
+}
+
+// waiting marks the calling goroutine as waiting until done is called on the result,
+// if clock is a SimClock; the goroutine must have been started by spawn.
+// The wait ends when timer fires, which may be nil, or when ready reports true.
+func waiting(clock Clock, timer Timer, ready func() bool) *simWait {
+	c, ok := clock.(*SimClock)
+	if !ok {
+		return nil
+	}
+	w := &simWait{c: c, ready: ready}
+	w.timer, _ = timer.(*simTimer)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if (w.timer != nil && len(w.timer.ch) > 0) || ready() {
+		w.woken = true
+		return w
+	}
+	c.busy--
+	c.idle.Broadcast()
+	c.waits[w] = struct{}{}
+	return w
+}
+
+// wake counts the goroutine of w as busy again, ahead of it going on.
+// w.c.mux must be held.
+func (w *simWait) wake() {
+	w.woken = true
+	w.c.busy++
+}
+
+// done ends the wait started by waiting.
+func (w *simWait) done() {
+	if w == nil {
+		return
+	}
+	w.c.mux.Lock()
+	defer w.c.mux.Unlock()
+	delete(w.c.waits, w)
+	if !w.woken {
+		w.wake()
+	}
+}
+
+// spawn runs f in a new goroutine, which counts as busy until f returns if clock is a SimClock.
+func spawn(clock Clock, f func()) {
+	c, ok := clock.(*SimClock)
+	if !ok {
+		go f()
+		return
+	}
+	c.add(1)
+	go func() {
+		defer c.add(-1)
+		f()
+	}()
+}
+
+// closed reports whether ch is closed.
+func closed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
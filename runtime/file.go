@@ -1,44 +1,196 @@
 package runtime
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/insomnimus/inscript/ast"
+	"io"
 	"os"
 	"sync"
+	"time"
 )
 
-var fileMap = make(map[string]*File)
+// DefaultFileMode is the permissions of created files, unless set with filemode:=.
+const DefaultFileMode os.FileMode = 0644
 
+// maxLine is the most a lineWriter buffers before writing an incomplete line.
+const maxLine = 64 * 1024
+
+// files is the registry of the files commands write to.
+var files = registry{
+	m:       make(map[string]*File),
+	closing: make(map[string]*File),
+}
+
+type registry struct {
+	mux sync.Mutex
+	m   map[string]*File
+	// files whose last user is done, being closed
+	closing map[string]*File
+}
+
+// File is a file shared by every command writing to it.
+// It's closed once the last command using it is done.
+// Writes to a File are serialised.
 type File struct {
-	ID      string
-	File    *os.File
-	mux     sync.Mutex
-	ActiveN int
+	ID   string
+	File *os.File
+	mux  sync.Mutex
+	refs int
+
+	// set for files opened with OpenFile, for rotation
+	perm     os.FileMode
+	rotation ast.Rotation
+	size     int64
+	// when the file was last written to
+	last        time.Time
+	compressing sync.WaitGroup
+	// the File of the same path that was being closed when this one was opened
+	prev *File
 }
 
+// Add registers one more user of f.
 func (f *File) Add() {
-	f.ActiveN++
+	files.mux.Lock()
+	defer files.mux.Unlock()
+	f.refs++
 }
 
+// Done unregisters a user of f, closing it if it was the last one.
 func (f *File) Done() {
+	if f == nil {
+		return
+	}
+	files.mux.Lock()
+	f.refs--
+	if f.refs > 0 {
+		files.mux.Unlock()
+		return
+	}
+	if files.m[f.ID] == f {
+		delete(files.m, f.ID)
+	}
+	files.closing[f.ID] = f
+	// closing waits for compression, which mustn't hold up the other files
+	files.mux.Unlock()
+	f.mux.Lock()
+	f.File.Close()
+	f.compressing.Wait()
+	f.mux.Unlock()
+
+	files.mux.Lock()
+	defer files.mux.Unlock()
+	if files.closing[f.ID] == f {
+		delete(files.closing, f.ID)
+	}
+}
+
+// Write writes p to the file in one piece, rotating the file first if it's due.
+func (f *File) Write(p []byte) (int, error) {
 	f.mux.Lock()
 	defer f.mux.Unlock()
-	f.ActiveN--
-	if f.ActiveN <= 0 {
-		f.File.Close()
-		fileMap[f.ID] = nil
+	now := time.Now()
+	if f.due(len(p), now) {
+		if err := f.rotate(); err != nil {
+			return 0, fmt.Errorf("rotating %s: %w", f.File.Name(), err)
+		}
 	}
+	n, err := f.File.Write(p)
+	f.size += int64(n)
+	f.last = now
+	return n, err
 }
 
 func LookupFile(key string) (*File, bool) {
-	f, ok := fileMap[key]
-	return f, ok && f != nil && f.File != nil
+	files.mux.Lock()
+	defer files.mux.Unlock()
+	f, ok := files.m[key]
+	return f, ok
 }
 
 func RegisterFile(key string, f *os.File) *File {
+	files.mux.Lock()
+	defer files.mux.Unlock()
+	return files.register(key, f)
+}
+
+// register adds f to the registry with a single user.
+// r.mux must be held.
+func (r *registry) register(key string, f *os.File) *File {
 	file := &File{
-		ID:      key,
-		File:    f,
-		ActiveN: 1,
+		ID:   key,
+		File: f,
+		refs: 1,
 	}
-	fileMap[key] = file
+	r.m[key] = file
 	return file
 }
+
+// OpenFile returns the shared File for writing to path, opening it if no command has it open.
+// Unless appendMode is set, a file is truncated when it's opened;
+// while it's open, writes are always appended so repeated runs and other commands
+// writing to it don't overwrite each other.
+// If the file doesn't exist, it's created with the given permissions, or DefaultFileMode if perm is 0.
+func OpenFile(path string, appendMode bool, perm os.FileMode) (*File, error) {
+	files.mux.Lock()
+	defer files.mux.Unlock()
+	if file, ok := files.m[path]; ok {
+		file.refs++
+		return file, nil
+	}
+	if perm == 0 {
+		perm = DefaultFileMode
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !appendMode {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	file := files.register(path, f)
+	file.perm = perm
+	file.prev = files.closing[path]
+	file.last = time.Now()
+	if info, err := f.Stat(); err == nil {
+		file.size = info.Size()
+		if file.size > 0 {
+			file.last = info.ModTime()
+		}
+	}
+	return file, nil
+}
+
+// lineWriter buffers what's written to it and passes it on in complete lines,
+// so that the lines of commands writing to the same file don't get mixed up.
+// Lines longer than maxLine are passed on in pieces.
+// A lineWriter is used by a single run of a command; it's not safe for concurrent use.
+type lineWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	i := bytes.LastIndexByte(l.buf, '\n')
+	if i < 0 {
+		if len(l.buf) >= maxLine {
+			return len(p), l.Flush()
+		}
+		return len(p), nil
+	}
+	_, err := l.w.Write(l.buf[:i+1])
+	l.buf = append(l.buf[:0], l.buf[i+1:]...)
+	return len(p), err
+}
+
+// Flush writes out any incomplete line left in the buffer.
+func (l *lineWriter) Flush() error {
+	if len(l.buf) == 0 {
+		return nil
+	}
+	_, err := l.w.Write(l.buf)
+	l.buf = l.buf[:0]
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package runtime
+
+import "os"
+
+func tryFlock(f *os.File) (bool, error) {
+	return false, errFlockUnsupported
+}
@@ -0,0 +1,219 @@
+package runtime
+
+import (
+	"fmt"
+	"github.com/insomnimus/inscript/ast"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An instance is a single run of a process.
+type instance struct {
+	// the number of the run, starting at 1
+	iter      int
+	cmd       *exec.Cmd
+	stdinPath string
+	stdin     *os.File
+	buffers   []*lineWriter
+	// the files of this run alone
+	files      []*File
+	decorators []*decorator
+	// the output kept by !capture, if any
+	capture *captureBuffer
+	// the stream the run reads from, with stdin:= @job
+	stream *stream
+	stop   chan struct{}
+}
+
+// newInstance prepares a fresh command for the iter'th run of p, evaluating its templates
+// and opening the files of the run.
+// The number of the run and the name of the job are passed to the child
+// as INSCRIPT_ITER and INSCRIPT_JOB.
+// Stubbed runs have nothing to prepare.
+func (p *Process) newInstance(iter int) (_ *instance, err error) {
+	if p.stub != nil {
+		return &instance{iter: iter}, nil
+	}
+	data := runData{
+		Name: jobName(p.Command),
+		Iter: iter,
+		now:  p.clock.Now(),
+	}
+	dir := p.dir
+	if p.dirTmpl != nil {
+		if dir, err = data.execute(p.dirTmpl); err != nil {
+			return nil, fmt.Errorf("dir:= %w", err)
+		}
+		if dir, err = expandHome(dir); err != nil {
+			return nil, err
+		}
+	}
+	cmd := exec.Command(p.Command.Command, p.Command.Args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"INSCRIPT_ITER="+strconv.Itoa(iter),
+		"INSCRIPT_JOB="+data.Name,
+	)
+	in := &instance{
+		iter:      iter,
+		cmd:       cmd,
+		stdinPath: p.stdinPath,
+		stream:    p.in,
+	}
+	defer func() {
+		if err != nil {
+			in.close()
+		}
+	}()
+	stdout, err := in.open(p, p.stdout, dir, data)
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := in.open(p, p.stderr, dir, data)
+	if err != nil {
+		return nil, err
+	}
+	if p.stdin != nil {
+		cmd.Stdin = p.stdin
+	}
+	if p.Command.Input != "" {
+		cmd.Stdin = strings.NewReader(p.Command.Input)
+	}
+	cmd.Stdout = in.output(stdout, p.Command)
+	cmd.Stderr = in.output(stderr, p.Command)
+	return in, nil
+}
+
+// open opens the files of the run among targets, the ones whose paths are templates.
+func (in *instance) open(p *Process, targets []io.Writer, dir string, data runData) ([]io.Writer, error) {
+	ws := make([]io.Writer, len(targets))
+	for i, w := range targets {
+		t, ok := w.(templateTarget)
+		if !ok {
+			ws[i] = w
+			continue
+		}
+		path, err := data.execute(t.tmpl)
+		if err != nil {
+			return nil, err
+		}
+		if path, err = p.resolve(dir, path); err != nil {
+			return nil, err
+		}
+		f, err := OpenFile(path, t.appendMode, p.Command.FileMode)
+		if err != nil {
+			return nil, err
+		}
+		if p.Command.Rotate.Enabled() {
+			f.rotateBy(p.Command.Rotate)
+		}
+		in.files = append(in.files, f)
+		ws[i] = f
+	}
+	return ws, nil
+}
+
+// output returns the writer the run should use for the given targets.
+// Shared files and streams are written to through a line buffer of the run
+// and !capture to an in-memory buffer of the run;
+// several targets all get a copy of the output.
+// The lines written to files and the terminal get the prefix:= and timestamps:= of cmd.
+func (in *instance) output(targets []io.Writer, cmd *ast.Command) io.Writer {
+	ws := make([]io.Writer, 0, len(targets))
+	for _, w := range targets {
+		switch t := w.(type) {
+		case *File, *os.File:
+			if d := newDecorator(t, cmd); d != nil {
+				in.decorators = append(in.decorators, d)
+				w = in.buffer(d)
+			} else if f, ok := t.(*File); ok {
+				w = in.buffer(f)
+			}
+		case *stream:
+			w = in.buffer(t)
+		case captureTarget:
+			if in.capture == nil {
+				in.capture = &captureBuffer{}
+			}
+			w = in.capture
+		}
+		ws = append(ws, w)
+	}
+	switch len(ws) {
+	case 0:
+		return nil
+	case 1:
+		return ws[0]
+	default:
+		return io.MultiWriter(ws...)
+	}
+}
+
+// buffer returns a line buffer of the run writing to w.
+func (in *instance) buffer(w io.Writer) *lineWriter {
+	lw := &lineWriter{w: w}
+	in.buffers = append(in.buffers, lw)
+	return lw
+}
+
+// start opens the stdin file or stream of the run, if any, and starts the command.
+func (in *instance) start() error {
+	if in.stdinPath != "" {
+		f, err := os.Open(in.stdinPath)
+		switch {
+		case err == nil:
+			in.stdin = f
+			in.cmd.Stdin = f
+		// a missing file is read as empty
+		case !os.IsNotExist(err):
+			in.close()
+			return err
+		}
+	}
+	if in.stream != nil {
+		in.stop = make(chan struct{})
+		f, err := in.stream.pipe(in.stop)
+		if err != nil {
+			in.close()
+			return err
+		}
+		in.stdin = f
+		in.cmd.Stdin = f
+	}
+	now := time.Now()
+	for _, d := range in.decorators {
+		d.start = now
+	}
+	if err := in.cmd.Start(); err != nil {
+		in.close()
+		return err
+	}
+	return nil
+}
+
+// wait waits for the command to exit and flushes its output.
+func (in *instance) wait() error {
+	err := in.cmd.Wait()
+	in.close()
+	return err
+}
+
+func (in *instance) close() {
+	for _, lw := range in.buffers {
+		lw.Flush()
+	}
+	if in.stop != nil {
+		close(in.stop)
+	}
+	if in.stdin != nil {
+		in.stdin.Close()
+	}
+	for _, f := range in.files {
+		f.Done()
+	}
+	in.files = nil
+}
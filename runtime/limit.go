@@ -0,0 +1,158 @@
+package runtime
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Limiter limits how many commands may run at once, both in total and per pool.
+// Commands waiting for a slot are let through by priority, then in statement order.
+// A nil *Limiter imposes no limits.
+type Limiter struct {
+	mux     sync.Mutex
+	max     int
+	pools   map[string]int
+	running int
+	inPool  map[string]int
+	waiting []*waiter
+	arrived int
+}
+
+type waiter struct {
+	pool     string
+	priority int
+	seq      int
+	arrival  int
+	ready    chan struct{}
+}
+
+// NewLimiter returns a Limiter that allows max commands to run at once,
+// and pools[name] commands at once in the pool called name.
+// A limit of 0 means no limit.
+func NewLimiter(max int, pools map[string]int) *Limiter {
+	l := &Limiter{
+		max:    max,
+		pools:  make(map[string]int, len(pools)),
+		inPool: make(map[string]int),
+	}
+	for name, n := range pools {
+		l.pools[name] = n
+	}
+	return l
+}
+
+// serializes reports whether commands in the pools a and b can never run at the same time.
+func (l *Limiter) serializes(a, b string) bool {
+	if l == nil {
+		return false
+	}
+	return l.max == 1 || (a != "" && a == b && l.pools[a] == 1)
+}
+
+// Acquire blocks until a command in the given pool may run, or ctx is cancelled.
+// Waiting commands with a higher priority go first; among equal priorities,
+// the one with the lower seq (statement index) goes first.
+// On success, the returned function must be called once the command finishes.
+func (l *Limiter) Acquire(ctx context.Context, pool string, priority, seq int) (release func(), err error) {
+	return l.acquire(ctx, nil, pool, priority, seq)
+}
+
+// acquire is Acquire, waiting on clock.
+func (l *Limiter) acquire(ctx context.Context, clock Clock, pool string, priority, seq int) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mux.Lock()
+	l.arrived++
+	w := &waiter{
+		pool:     pool,
+		priority: priority,
+		seq:      seq,
+		arrival:  l.arrived,
+		ready:    make(chan struct{}),
+	}
+	i := sort.Search(len(l.waiting), func(i int) bool {
+		return w.before(l.waiting[i])
+	})
+	l.waiting = append(l.waiting, nil)
+	copy(l.waiting[i+1:], l.waiting[i:])
+	l.waiting[i] = w
+	l.dispatch()
+	l.mux.Unlock()
+
+	release = func() {
+		l.mux.Lock()
+		defer l.mux.Unlock()
+		l.running--
+		l.inPool[pool]--
+		l.dispatch()
+	}
+	wait := waiting(clock, nil, func() bool {
+		return ctx.Err() != nil || closed(w.ready)
+	})
+	select {
+	case <-w.ready:
+		wait.done()
+		return release, nil
+	case <-ctx.Done():
+		wait.done()
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	select {
+	case <-w.ready:
+		// got a slot in the meantime, give it back
+		l.running--
+		l.inPool[pool]--
+		l.dispatch()
+	default:
+		for i, x := range l.waiting {
+			if x == w {
+				l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil, ctx.Err()
+}
+
+func (w *waiter) before(x *waiter) bool {
+	if w.priority != x.priority {
+		return w.priority > x.priority
+	}
+	if w.seq != x.seq {
+		return w.seq < x.seq
+	}
+	return w.arrival < x.arrival
+}
+
+// dispatch lets through every waiting command that fits within the limits, in order.
+// l.mux must be held.
+func (l *Limiter) dispatch() {
+	waiting := l.waiting[:0]
+	for _, w := range l.waiting {
+		if l.fits(w.pool) {
+			l.running++
+			l.inPool[w.pool]++
+			close(w.ready)
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+	for i := len(waiting); i < len(l.waiting); i++ {
+		l.waiting[i] = nil
+	}
+	l.waiting = waiting
+}
+
+func (l *Limiter) fits(pool string) bool {
+	if l.max > 0 && l.running >= l.max {
+		return false
+	}
+	if n := l.pools[pool]; pool != "" && n > 0 && l.inPool[pool] >= n {
+		return false
+	}
+	return true
+}
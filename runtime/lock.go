@@ -0,0 +1,157 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// flockInterval is how often a busy lock file is retried.
+const flockInterval = 100 * time.Millisecond
+
+var errFlockUnsupported = errors.New("file locks are not supported on this platform")
+
+// locks holds the named locks of lock:= fields.
+type locks struct {
+	mux sync.Mutex
+	// the commands waiting for each lock that is held, in order of arrival
+	m map[string][]chan struct{}
+}
+
+// acquire takes the lock called name, waiting until it's free or ctx is cancelled.
+// On success, the returned function must be called to release the lock.
+func (l *locks) acquire(ctx context.Context, clock Clock, name string) (release func(), err error) {
+	if l == nil || name == "" {
+		return func() {}, nil
+	}
+	release = func() {
+		l.mux.Lock()
+		defer l.mux.Unlock()
+		l.pass(name)
+	}
+	l.mux.Lock()
+	if l.m == nil {
+		l.m = make(map[string][]chan struct{})
+	}
+	queue, held := l.m[name]
+	if !held {
+		l.m[name] = nil
+		l.mux.Unlock()
+		return release, nil
+	}
+	ready := make(chan struct{})
+	l.m[name] = append(queue, ready)
+	l.mux.Unlock()
+
+	w := waiting(clock, nil, func() bool {
+		return ctx.Err() != nil || closed(ready)
+	})
+	select {
+	case <-ready:
+		w.done()
+		return release, nil
+	case <-ctx.Done():
+		w.done()
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	select {
+	case <-ready:
+		// got the lock in the meantime, pass it on
+		l.pass(name)
+	default:
+		queue := l.m[name]
+		for i, x := range queue {
+			if x == ready {
+				l.m[name] = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil, ctx.Err()
+}
+
+// pass hands the lock called name over to the first command waiting for it, or frees it.
+// l.mux must be held.
+func (l *locks) pass(name string) {
+	queue := l.m[name]
+	if len(queue) == 0 {
+		delete(l.m, name)
+		return
+	}
+	close(queue[0])
+	l.m[name] = queue[1:]
+}
+
+// flockFile opens (creating if needed) the file at path and takes an exclusive advisory lock on it,
+// waiting until the lock is free or ctx is cancelled.
+// Closing the returned file releases the lock.
+func flockFile(ctx context.Context, path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		ok, err := tryFlock(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ok {
+			return f, nil
+		}
+		if err := sleep(ctx, realClock{}, flockInterval); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+}
+
+// acquire takes every lock the command needs for a run, in order:
+// the lock:= lock, the lockfile:= lock and a slot from the limiter.
+// On success, the returned function must be called to release them.
+func (p *Process) acquire(ctx context.Context) (release func(), err error) {
+	unlock, err := p.locks.acquire(ctx, p.clock, p.Command.Lock)
+	if err != nil {
+		return nil, err
+	}
+	// simulations stand in for lock files with named locks, so that nothing is created
+	if p.stub != nil && p.Command.LockFile != "" {
+		unlockFile, err := p.locks.acquire(ctx, p.clock, "lockfile:"+p.Command.LockFile)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		inner := unlock
+		unlock = func() {
+			unlockFile()
+			inner()
+		}
+	}
+	var file *os.File
+	if p.lockFile != "" {
+		file, err = flockFile(ctx, p.lockFile)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	done, err := p.limiter.acquire(ctx, p.clock, p.Command.Pool, p.Command.Priority, p.seq)
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		unlock()
+		return nil, err
+	}
+	return func() {
+		done()
+		if file != nil {
+			file.Close()
+		}
+		unlock()
+	}, nil
+}
@@ -0,0 +1,63 @@
+package runtime
+
+import (
+	"github.com/insomnimus/inscript/ast"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	randMux sync.Mutex
+	random  = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// hostname is mixed into splay:= offsets so that every host gets its own.
+	hostname, _ = os.Hostname()
+)
+
+// Seed seeds the random source used for jitter:= offsets.
+func Seed(seed int64) {
+	randMux.Lock()
+	defer randMux.Unlock()
+	random.Seed(seed)
+}
+
+// jobName returns the name of the command, or its command line if it isn't named.
+func jobName(cmd *ast.Command) string {
+	if cmd.Name != "" {
+		return cmd.Name
+	}
+	return strings.Join(append([]string{cmd.Command}, cmd.Args...), " ")
+}
+
+// offset returns how long a scheduled run should be delayed:
+// the stable splay:= offset of the job plus a random duration within jitter:=.
+func (p *Process) offset() time.Duration {
+	return splay(hostname, p.Command) + jitter(p.Command.Jitter)
+}
+
+// jitter returns a random duration in [0, max).
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	randMux.Lock()
+	defer randMux.Unlock()
+	return time.Duration(random.Int63n(int64(max)))
+}
+
+// splay returns a duration in [0, cmd.Splay) derived from the host and the job name,
+// so it stays the same across runs on one host but differs between hosts.
+func splay(host string, cmd *ast.Command) time.Duration {
+	if cmd.Splay <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(host))
+	h.Write([]byte{0})
+	h.Write([]byte(jobName(cmd)))
+	return time.Duration(h.Sum64() % uint64(cmd.Splay))
+}
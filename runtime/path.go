@@ -0,0 +1,53 @@
+package runtime
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// expandHome replaces a leading ~ or ~user in path with the home directory.
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~") {
+		return path, nil
+	}
+	name := path[1:]
+	rest := ""
+	if i := strings.IndexAny(name, `/\`); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+	var home string
+	if name == "" {
+		h, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		home = h
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		home = u.HomeDir
+	}
+	return home + rest, nil
+}
+
+// resolvePath returns the cleaned absolute path of a redirect target.
+// Relative paths are joined to dir or, if dir is empty, to base;
+// both may themselves be relative to the working directory.
+func resolvePath(base, dir, path string) (string, error) {
+	path, err := expandHome(path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		if dir != "" {
+			path = filepath.Join(dir, path)
+		} else {
+			path = filepath.Join(base, path)
+		}
+	}
+	return filepath.Abs(path)
+}
@@ -0,0 +1,120 @@
+package runtime
+
+import (
+	"fmt"
+	"github.com/insomnimus/inscript/ast"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DryRun writes what Run would do with cmds to w, without running or opening anything.
+// It reports the errors Run would find before starting any command.
+func (r *Runner) DryRun(w io.Writer, cmds []*ast.Command) error {
+	if _, err := connect(cmds); err != nil {
+		return err
+	}
+	for i, cmd := range cmds {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		if err := r.plan(w, i+1, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// plan writes the plan of the n'th command.
+func (r *Runner) plan(w io.Writer, n int, cmd *ast.Command) error {
+	argv := make([]string, 0, len(cmd.Args)+1)
+	for _, a := range append([]string{cmd.Command}, cmd.Args...) {
+		argv = append(argv, strconv.Quote(a))
+	}
+	fmt.Fprintf(w, "%d: %s\n", n, jobName(cmd))
+	fmt.Fprintf(w, "\targv:     [%s]\n", strings.Join(argv, " "))
+
+	dir, shown := cmd.Dir, cmd.Dir
+	if !isTemplate(dir) {
+		var err error
+		if dir, err = expandHome(dir); err != nil {
+			return err
+		}
+		// without a dir:=, commands run in the working directory of inscript
+		if shown, err = filepath.Abs(dir); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "\tdir:      %s\n", shown)
+	if isAsync(cmd) {
+		fmt.Fprintln(w, "\tmode:     async")
+	} else {
+		fmt.Fprintln(w, "\tmode:     sync")
+	}
+	if s := schedule(cmd); s != "" {
+		fmt.Fprintf(w, "\tschedule: %s\n", s)
+	}
+
+	// the paths are resolved like createProcess does, templates are shown as they are
+	resolve := func(target string) (string, error) {
+		switch {
+		case target == "" || strings.HasPrefix(target, "!") || strings.HasPrefix(target, "@"):
+			return target, nil
+		case isTemplate(target) || isTemplate(cmd.Dir):
+			return target + " (per run)", nil
+		default:
+			return resolvePath(r.Dir, dir, target)
+		}
+	}
+	switch {
+	case cmd.Input != "":
+		fmt.Fprintf(w, "\tstdin:    %q\n", cmd.Input)
+	case cmd.Stdin != "":
+		path, err := resolve(cmd.Stdin)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "\tstdin:    %s\n", path)
+	}
+	for _, out := range []struct {
+		name string
+		rs   []ast.Redirect
+	}{{"stdout", cmd.Stdout}, {"stderr", cmd.Stderr}} {
+		if len(out.rs) == 0 {
+			continue
+		}
+		targets := make([]string, 0, len(out.rs))
+		for _, rd := range out.rs {
+			path, err := resolve(rd.Target)
+			if err != nil {
+				return err
+			}
+			targets = append(targets, ast.Redirect{Target: path, Append: rd.Append}.String())
+		}
+		fmt.Fprintf(w, "\t%s:   %s\n", out.name, strings.Join(targets, ", "))
+	}
+	return nil
+}
+
+// schedule describes when a command runs, or returns "" if it runs once right away.
+func schedule(cmd *ast.Command) string {
+	var parts []string
+	switch {
+	case cmd.Every > 0:
+		parts = append(parts, fmt.Sprintf("every %s", cmd.Every))
+		if cmd.Times > 0 {
+			parts = append(parts, fmt.Sprintf("%d times", cmd.Times))
+		}
+		parts = append(parts, fmt.Sprintf("overlap %s", cmd.Overlap))
+	case cmd.Times > 0:
+		parts = append(parts, fmt.Sprintf("%d times in a row", cmd.Times))
+	}
+	if cmd.Jitter > 0 {
+		parts = append(parts, fmt.Sprintf("jitter up to %s", cmd.Jitter))
+	}
+	if cmd.Splay > 0 {
+		parts = append(parts, fmt.Sprintf("splay %s", splay(hostname, cmd)))
+	}
+	return strings.Join(parts, ", ")
+}
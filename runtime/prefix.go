@@ -0,0 +1,94 @@
+package runtime
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/insomnimus/inscript/ast"
+	"hash/fnv"
+	"io"
+	"os"
+	"time"
+)
+
+// colors are the ANSI colours prefixes are shown in on a terminal.
+var colors = []int{31, 32, 33, 34, 35, 36, 91, 92, 93, 94, 95, 96}
+
+// decorator writes the lines passed to it with the prefix:= and timestamps:= of a job.
+// It's meant to be written to by a lineWriter, so that lines reach it whole.
+type decorator struct {
+	w          io.Writer
+	prefix     string
+	timestamps ast.Timestamps
+	// when the run started, for elapsed timestamps
+	start time.Time
+	// whether the last write ended in the middle of a line
+	mid bool
+	buf []byte
+}
+
+// newDecorator returns a decorator writing to w, or nil if cmd has neither prefix:= nor timestamps:=.
+// Prefixes are coloured when w is a terminal.
+func newDecorator(w io.Writer, cmd *ast.Command) *decorator {
+	if cmd.Prefix == "" && cmd.Timestamps == ast.TimestampsOff {
+		return nil
+	}
+	d := &decorator{
+		w:          w,
+		prefix:     cmd.Prefix,
+		timestamps: cmd.Timestamps,
+	}
+	if d.prefix != "" && isTerminal(w) && os.Getenv("NO_COLOR") == "" {
+		h := fnv.New32a()
+		h.Write([]byte(d.prefix))
+		d.prefix = fmt.Sprintf("\x1b[%dm%s\x1b[0m", colors[h.Sum32()%uint32(len(colors))], d.prefix)
+	}
+	return d
+}
+
+func (d *decorator) Write(p []byte) (int, error) {
+	d.buf = d.buf[:0]
+	for rest := p; len(rest) > 0; {
+		if !d.mid {
+			d.buf = d.decorate(d.buf)
+		}
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		d.buf = append(d.buf, line...)
+		rest = rest[len(line):]
+		d.mid = line[len(line)-1] != '\n'
+	}
+	if _, err := d.w.Write(d.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// decorate appends the timestamp and prefix of a line to buf.
+func (d *decorator) decorate(buf []byte) []byte {
+	now := time.Now()
+	switch d.timestamps {
+	case ast.TimestampsLocal:
+		buf = now.AppendFormat(buf, "2006-01-02 15:04:05 ")
+	case ast.TimestampsRFC3339:
+		buf = now.AppendFormat(buf, time.RFC3339+" ")
+	case ast.TimestampsElapsed:
+		buf = append(buf, fmt.Sprintf("%9.3fs ", now.Sub(d.start).Seconds())...)
+	}
+	if d.prefix != "" {
+		buf = append(buf, d.prefix...)
+		buf = append(buf, " | "...)
+	}
+	return buf
+}
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,137 @@
+package runtime
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/insomnimus/inscript/ast"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// rotateBy sets how f is rotated, unless another command writing to it already has.
+func (f *File) rotateBy(r ast.Rotation) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if !f.rotation.Enabled() {
+		f.rotation = r
+	}
+}
+
+// due reports whether f must be rotated before n more bytes are written to it at now.
+// Empty files are never rotated.
+// f.mux must be held.
+func (f *File) due(n int, now time.Time) bool {
+	r := f.rotation
+	if f.size == 0 || !r.Enabled() {
+		return false
+	}
+	if r.Size > 0 && f.size+int64(n) > r.Size {
+		return true
+	}
+	return r.Daily && !sameDay(f.last, now)
+}
+
+func sameDay(a, b time.Time) bool {
+	y1, m1, d1 := a.Date()
+	y2, m2, d2 := b.Date()
+	return y1 == y2 && m1 == m2 && d1 == d2
+}
+
+// rotate renames the file to path.1, shifting the older ones to path.2 and so on
+// and removing the ones past keep:=, then starts a new, empty file.
+// With compress:=, the rotated files are named path.1.gz and so on;
+// the file that was just rotated is compressed in the background.
+// f.mux must be held.
+func (f *File) rotate() error {
+	// the previous rotation must be done compressing before it's shifted,
+	// even if it was made by an earlier File of the same path
+	f.compressing.Wait()
+	if f.prev != nil {
+		f.prev.compressing.Wait()
+		f.prev = nil
+	}
+	path := f.File.Name()
+	ext := ""
+	if f.rotation.Compress {
+		ext = ".gz"
+	}
+	name := func(i int) string {
+		return fmt.Sprintf("%s.%d%s", path, i, ext)
+	}
+
+	top := f.rotation.Keep
+	if top == 0 {
+		// keep all of them: shift up to the first free name
+		for top = 1; exists(name(top)); top++ {
+		}
+	} else if err := os.Remove(name(top)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := top - 1; i >= 1; i-- {
+		if err := os.Rename(name(i), name(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	rotated := name(1)
+	if f.rotation.Compress {
+		rotated = fmt.Sprintf("%s.1", path)
+	}
+	if err := os.Rename(path, rotated); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, f.perm)
+	if err != nil {
+		return err
+	}
+	f.File = file
+	f.size = 0
+
+	if f.rotation.Compress {
+		f.compressing.Add(1)
+		go func() {
+			defer f.compressing.Done()
+			if err := compress(rotated, name(1), f.perm); err != nil {
+				log.Printf("compressing %s: %s", rotated, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// compress gzips src into dst and removes src.
+func compress(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,128 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"github.com/insomnimus/inscript/ast"
+	"sync"
+	"time"
+)
+
+// Runner runs the commands of a script.
+type Runner struct {
+	// Dir is the directory relative redirect paths of commands without a dir:= are resolved against,
+	// usually the directory of the script.
+	// If empty, the working directory is used.
+	Dir string
+
+	limiter *Limiter
+	locks   locks
+	// set by Simulate
+	clock Clock
+	stub  Stub
+}
+
+// NewRunner returns a Runner that applies the given script-wide settings.
+func NewRunner(s ast.Settings) *Runner {
+	r := &Runner{}
+	if s.MaxParallel > 0 || len(s.Pools) > 0 {
+		r.limiter = NewLimiter(s.MaxParallel, s.Pools)
+	}
+	return r
+}
+
+// Run runs cmds in statement order.
+// Sync commands are waited for before the next command starts, async ones run in the background.
+// Every run of every command, including repetitions, counts against the concurrency limits.
+//
+// Run returns once every command has finished.
+// If a command fails, the others are stopped and its error is returned.
+// If ctx is cancelled, Run stops every running command and returns nil.
+func (r *Runner) Run(ctx context.Context, cmds []*ast.Command) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg     sync.WaitGroup
+		mux    sync.Mutex
+		failed error
+	)
+	// fail records the first error and stops every other command
+	fail := func(err error) {
+		mux.Lock()
+		defer mux.Unlock()
+		if failed == nil {
+			failed = err
+			cancel()
+		}
+	}
+	run := func(p *Process) {
+		err := p.Run(ctx)
+		if err != nil && ctx.Err() == nil {
+			fail(p.wrapError(err))
+		}
+	}
+
+	js, err := connect(cmds)
+	if err != nil {
+		return err
+	}
+	// the files of the script are kept open until it finishes,
+	// so commands writing to the same file after one another don't truncate it
+	var held []*File
+	defer func() {
+		for _, f := range held {
+			f.Done()
+		}
+	}()
+	for i, cmd := range cmds {
+		if ctx.Err() != nil {
+			break
+		}
+		p, err := createProcess(cmd, env{
+			base:    r.Dir,
+			streams: js,
+			clock:   r.clock,
+			stub:    r.stub,
+		})
+		if err != nil {
+			fail(err)
+			break
+		}
+		for _, f := range p.files {
+			f.Add()
+			held = append(held, f)
+		}
+		p.limiter = r.limiter
+		p.locks = &r.locks
+		p.seq = i
+		// simulations settle the clock between steps instead
+		if r.stub == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if p.Async {
+			wg.Add(1)
+			spawn(r.clock, func() {
+				defer wg.Done()
+				run(p)
+			})
+			continue
+		}
+		run(p)
+	}
+
+	// the commands waited for count as busy themselves,
+	// and once they're done, nothing is left to happen on the clock
+	w := waiting(r.clock, nil, func() bool {
+		return false
+	})
+	wg.Wait()
+	w.done()
+	return failed
+}
+
+func (p *Process) wrapError(err error) error {
+	if p.Command.Name != "" {
+		return fmt.Errorf("command %s: %w", p.Command.Name, err)
+	}
+	return err
+}
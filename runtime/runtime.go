@@ -1,172 +1,338 @@
 package runtime
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/insomnimus/inscript/ast"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 )
 
+// killTimeout is how long a child is given to exit after being interrupted
+// before it is killed.
+var killTimeout = 5 * time.Second
+
 type Process struct {
-	Cmd     *exec.Cmd
 	Command *ast.Command
 	Async   bool
-	Kill    func()
-	Run     func() error
-	killed  bool
+
+	mu        sync.Mutex
+	pending   *instance
+	killed    bool
+	running   bool
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	files     []*File
+	lockFile  string
+	run       func(ctx context.Context) error
+	// the number of runs so far
+	iter  int
+	clock Clock
+	stub  Stub
+	// the output of the last finished run, with !capture
+	output []byte
+	// the stream the runs read from and the streams they write to, with @job
+	in    *stream
+	feeds []*stream
+
+	// where the runs read from and write to
+	base           string
+	dir            string
+	dirTmpl        *template.Template
+	stdin          io.Reader
+	stdinPath      string
+	stdout, stderr []io.Writer
+
+	// set by the Runner
+	limiter *Limiter
+	locks   *locks
+	seq     int
 }
 
+// CreateProcess prepares cmd to be run.
+// Relative redirect paths are resolved against the working directory of the command,
+// or inscript's own working directory if it doesn't have one.
 func CreateProcess(cmd *ast.Command) (*Process, error) {
-	command := exec.Command(cmd.Command, cmd.Args...)
-	if cmd.Dir != "" {
-		command.Dir = cmd.Dir
-	}
-	var stdin, stdout, stderr *File
-	var err error
-	if cmd.Stderr != "" {
-		switch {
-		case cmd.Stderr == "!stderr":
-			command.Stderr = os.Stderr
-		case cmd.Stderr == "!stdout":
-			command.Stderr = os.Stdout
-		default:
-			if file, ok := LookupFile(cmd.Dir + cmd.Stderr); ok {
-				command.Stderr = file.File
-				stderr = file
-				file.Add()
-				break
-			}
-			var file *os.File
-			if _, e := os.Stat(cmd.Dir + cmd.Stderr); os.IsNotExist(e) {
-				file, err = os.Create(cmd.Dir + cmd.Stderr)
-			} else {
-				file, err = os.OpenFile(cmd.Dir+cmd.Stderr, os.O_WRONLY, 0764)
+	return createProcess(cmd, env{})
+}
+
+// env is what the processes of a Runner share.
+type env struct {
+	// what relative redirect paths are resolved against if there's no dir:=
+	base string
+	// the streams between jobs
+	streams *jobStreams
+	// the system clock if nil
+	clock Clock
+	// if set, runs call it instead of starting their command, and no files are opened
+	stub Stub
+}
+
+// Stub stands in for the iter'th run of cmd, for simulations.
+// It's called once any locks and limits of the run are acquired.
+type Stub func(ctx context.Context, cmd *ast.Command, iter int) error
+
+// createProcess prepares cmd to be run, resolving relative redirect paths against dir:=
+// or, if the command doesn't have a working directory, e.base.
+// References to other jobs are looked up in e.streams.
+func createProcess(cmd *ast.Command, e env) (_ *Process, err error) {
+	if e.clock == nil {
+		e.clock = realClock{}
+	}
+	js := e.streams
+	p := &Process{Command: cmd, base: e.base, clock: e.clock, stub: e.stub}
+	if isTemplate(cmd.Dir) {
+		if p.dirTmpl, err = parseTemplate(cmd.Dir); err != nil {
+			return nil, fmt.Errorf("dir:= %w", err)
+		}
+	} else if p.dir, err = expandHome(cmd.Dir); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			for _, f := range p.files {
+				f.Done()
 			}
+		}
+	}()
+	open := func(target string, appendMode bool) (io.Writer, error) {
+		switch target {
+		case "!stdout":
+			return os.Stdout, nil
+		case "!stderr":
+			return os.Stderr, nil
+		case "!null":
+			return io.Discard, nil
+		case "!capture":
+			return captureTarget{}, nil
+		}
+		if name, ok := jobRef(target); ok {
+			s, err := js.stream(name)
 			if err != nil {
 				return nil, err
 			}
-			command.Stderr = file
-			stderr = RegisterFile(cmd.Dir+cmd.Stderr, file)
+			p.feeds = append(p.feeds, s)
+			return s, nil
 		}
-	}
-
-	if cmd.Stdout != "" {
-		switch {
-		case cmd.Stdout == "!stdout":
-			command.Stdout = os.Stdout
-		case cmd.Stdout == "!stderr":
-			command.Stdout = os.Stderr
-		case cmd.Stdout == cmd.Stderr && stderr != nil:
-			command.Stdout = stderr.File
-		default:
-			if file, ok := LookupFile(cmd.Dir + cmd.Stdout); ok {
-				file.Add()
-				command.Stdout = file.File
-				stdout = file
-				break
-			}
-			var file *os.File
-			if _, e := os.Stat(cmd.Dir + cmd.Stdout); os.IsNotExist(e) {
-				file, err = os.Create(cmd.Dir + cmd.Stdout)
-			} else {
-				file, err = os.OpenFile(cmd.Dir+cmd.Stdout, os.O_WRONLY, 0764)
-			}
+		if p.perRun(target) {
+			tmpl, err := parseTemplate(target)
 			if err != nil {
 				return nil, err
 			}
-			command.Stdout = file
-			stdout = RegisterFile(cmd.Dir+cmd.Stdout, file)
+			return templateTarget{tmpl: tmpl, appendMode: appendMode}, nil
 		}
-	}
-
-	if cmd.Stdin != "" {
-		switch {
-		case cmd.Stdin == "!stdin":
-			command.Stdin = os.Stdin
-		case cmd.Stdin != cmd.Stdout && cmd.Stdin != cmd.Stderr:
-			if file, ok := LookupFile(cmd.Dir + cmd.Stdin); ok {
-				command.Stdin = file.File
-				stdin = file
-				file.Add()
-				break
-			}
-			var file *os.File
-			if _, e := os.Stat(cmd.Dir + cmd.Stdin); !os.IsNotExist(e) {
-				file, err = os.Open(cmd.Dir + cmd.Stdin)
-				if err != nil {
-					return nil, err
-				}
-				command.Stdin = file
-				stdin = RegisterFile(cmd.Dir+cmd.Stdin, file)
-			}
+		path, err := p.resolve(p.dir, target)
+		if err != nil {
+			return nil, err
 		}
+		f, err := OpenFile(path, appendMode, cmd.FileMode)
+		if err != nil {
+			return nil, err
+		}
+		if cmd.Rotate.Enabled() {
+			f.rotateBy(cmd.Rotate)
+		}
+		p.files = append(p.files, f)
+		return f, nil
 	}
 
-	async := !cmd.Sync
-	if cmd.Every > 0 && cmd.Times == 0 {
-		async = true
-	}
-
-	p := &Process{
-		Cmd:     command,
-		Command: cmd,
-		Async:   async,
+	// stubbed runs have nothing to read or write
+	if p.stub != nil {
+		return p.finish(), nil
 	}
-
-	p.Kill = func() {
-		if p.Cmd == nil || p.Cmd.Process == nil {
-			p.killed = true
+	for _, r := range cmd.Stderr {
+		w, err := open(r.Target, r.Append)
+		if err != nil {
+			return nil, err
 		}
-		if p.killed {
-			return
+		p.stderr = append(p.stderr, w)
+	}
+	for _, r := range cmd.Stdout {
+		w, err := open(r.Target, r.Append)
+		if err != nil {
+			return nil, err
 		}
-		p.killed = true
-		if p.Async {
-			// process.Signal(sigint) does nothing on windows so we kill instead
-			if os.PathSeparator == '\\' {
-				p.Cmd.Process.Kill()
-			} else {
-				p.Cmd.Process.Signal(os.Interrupt)
+		p.stdout = append(p.stdout, w)
+	}
+	switch cmd.Stdin {
+	case "":
+	case "!stdin":
+		p.stdin = os.Stdin
+	case "!null":
+		// commands without a stdin read from the null device
+	case "!capture":
+		return nil, fmt.Errorf("!capture can't be used as stdin")
+	default:
+		if name, ok := jobRef(cmd.Stdin); ok {
+			if js == nil {
+				return nil, fmt.Errorf("@%s: jobs can only be referred to when running a script", name)
 			}
+			break
 		}
-		if stdin != nil {
-			stdin.Done()
+		// opened anew for every run, so that each run reads it from the start
+		if p.stdinPath, err = resolvePath(p.base, p.dir, cmd.Stdin); err != nil {
+			return nil, err
 		}
-		if stdout != nil {
-			stdout.Done()
-		}
-		if stderr != nil {
-			stderr.Done()
+	}
+
+	if cmd.LockFile != "" {
+		if p.lockFile, err = p.resolve(p.dir, cmd.LockFile); err != nil {
+			return nil, err
 		}
 	}
 
-	// monotonic and certain amount of iterations
-	if cmd.Every > 0 && cmd.Times > 0 {
-		p.monotonicTimesRunFunc()
-		return p, nil
+	if js != nil {
+		p.in = js.in[cmd]
+		// other jobs reading from this one get a copy of its stdout
+		for _, s := range js.feeds[cmd] {
+			p.stdout = append(p.stdout, s)
+			p.feeds = append(p.feeds, s)
+		}
 	}
 
+	return p.finish(), nil
+}
+
+// finish sets how p runs.
+func (p *Process) finish() *Process {
+	cmd := p.Command
+	p.Async = isAsync(cmd)
+	switch {
+	// monotonic, with or without a certain amount of iterations
+	case cmd.Every > 0:
+		p.run = p.runEvery
 	// certain amount of times
-	if cmd.Times > 0 {
-		p.timesRunFunc()
-		return p, nil
+	case cmd.Times > 0:
+		p.run = p.runTimes
+	// sync or async, doesn't matter here
+	default:
+		p.run = p.runOnce
 	}
+	return p
+}
 
-	// monotonic
-	if cmd.Every > 0 {
-		p.Async = true
-		p.monotonicRunFunc()
-		return p, nil
+// resolve returns the absolute path of the redirect file s of a run in dir,
+// creating its parent directories with mkdir:=.
+func (p *Process) resolve(dir, s string) (string, error) {
+	path, err := resolvePath(p.base, dir, s)
+	if err == nil && p.Command.Mkdir {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
 	}
+	return path, err
+}
 
-	// sync or async, doesn't matter here
-	p.Run = func() error {
-		defer p.Kill()
-		return p.Cmd.Run()
+// perRun reports whether the redirect file target is opened for every run:
+// if it's a template, or a relative path while dir:= is a template.
+func (p *Process) perRun(target string) bool {
+	if isTemplate(target) {
+		return true
+	}
+	if p.dirTmpl == nil {
+		return false
+	}
+	path, err := expandHome(target)
+	return err != nil || !filepath.IsAbs(path)
+}
+
+// Run runs the process until it completes, it is killed or ctx is cancelled.
+// Cancellation interrupts any pending sleep and stops the running child;
+// in that case the context's error is returned.
+func (p *Process) Run(ctx context.Context) error {
+	p.mu.Lock()
+	if p.killed {
+		p.mu.Unlock()
+		return context.Canceled
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p.cancel = cancel
+	p.running = true
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.killed = true
+		p.running = false
+		p.mu.Unlock()
+		cancel()
+		p.release()
+	}()
+	// repeating commands apply the offset to each of their runs themselves
+	if p.Command.Every == 0 {
+		if err := sleep(ctx, p.clock, p.offset()); err != nil {
+			return err
+		}
+	}
+	return p.run(ctx)
+}
+
+// Kill stops the process.
+// Its files are released once the running children have exited.
+// It is safe to call Kill concurrently and more than once.
+func (p *Process) Kill() {
+	p.mu.Lock()
+	p.killed = true
+	cancel := p.cancel
+	running := p.running
+	p.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	if !running {
+		p.release()
+	}
+}
+
+// release releases the files and streams of the process, once.
+func (p *Process) release() {
+	p.closeOnce.Do(func() {
+		for _, f := range p.files {
+			f.Done()
+		}
+		for _, s := range p.feeds {
+			s.done()
+		}
+		if p.in != nil {
+			p.in.close()
+		}
+		p.mu.Lock()
+		pending := p.pending
+		p.pending = nil
+		p.mu.Unlock()
+		if pending != nil {
+			pending.close()
+		}
+	})
+}
+
+// Killed reports whether Kill has been called or Run has returned.
+func (p *Process) Killed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.killed
+}
+
+// Cmd returns the command that will be used for the next run,
+// or nil if its templates can't be evaluated.
+func (p *Process) Cmd() *exec.Cmd {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending == nil {
+		in, err := p.newInstance(p.iter + 1)
+		if err != nil {
+			return nil
+		}
+		p.pending = in
 	}
-	return p, nil
+	return p.pending.cmd
 }
 
 func (p *Process) LogError(err error) {
@@ -182,122 +348,269 @@ func (p *Process) LogError(err error) {
 	log.Println(s)
 }
 
-func (p *Process) Refresh() {
-	cmd := exec.Command(p.Command.Command, p.Command.Args...)
-	cmd.Dir = p.Cmd.Dir
-	if p.Cmd.Stdin != nil {
-		cmd.Stdin = p.Cmd.Stdin
+// Refresh replaces the underlying command with a fresh one, ready for the next run.
+// The templates of the command are evaluated anew.
+func (p *Process) Refresh() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	in, err := p.newInstance(p.iter + 1)
+	if err != nil {
+		return err
 	}
-	if p.Cmd.Stderr != nil {
-		cmd.Stderr = p.Cmd.Stderr
+	if p.pending != nil {
+		p.pending.close()
 	}
-	if p.Cmd.Stdout != nil {
-		cmd.Stdout = p.Cmd.Stdout
+	p.pending = in
+	return nil
+}
+
+// take returns the instance for the upcoming run: the one prepared by Cmd or Refresh, or a fresh one.
+// Concurrent runs never share an *exec.Cmd.
+func (p *Process) take() (*instance, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.iter++
+	if in := p.pending; in != nil {
+		p.pending = nil
+		return in, nil
 	}
-	p.Cmd.Process.Signal(os.Interrupt)
-	p.Cmd = cmd
+	return p.newInstance(p.iter)
 }
 
-func (p *Process) timesRunFunc() {
-	p.Run = func() error {
-		defer p.Kill()
-		for i := 0; i < p.Command.Times; i++ {
-			err := p.Cmd.Run()
-			if err != nil {
-				return err
-			}
-			if i+1 < p.Command.Times {
-				p.Refresh()
-			}
-		}
-		return nil
+// runOnce runs the next command once.
+func (p *Process) runOnce(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	in, err := p.take()
+	if err != nil {
+		return err
 	}
+	return p.exec(ctx, in)
 }
 
-func (p *Process) _monotonicRunFunc() {
-	p.Run = func() (err error) {
-		defer p.Kill()
-		ticker := time.NewTicker(p.Command.Every)
-		defer ticker.Stop()
-		done := make(chan error, 5)
-		run := func() {
-			done <- p.Cmd.Run()
-		}
-		go func() {
-			for {
-				go run()
-				select {
-				case <-ticker.C:
-					p.Refresh()
-				case err = <-done:
-					if err != nil {
-						p.LogError(err)
-						return
-					}
-					p.Refresh()
-				}
-			}
-		}()
-		return
+// exec takes the locks of the command and runs the instance to completion.
+// If ctx is cancelled, the child is interrupted and, if it doesn't exit
+// in time, killed.
+func (p *Process) exec(ctx context.Context, in *instance) error {
+	release, err := p.acquire(ctx)
+	if err != nil {
+		in.close()
+		return err
+	}
+	defer release()
+	if p.stub != nil {
+		defer in.close()
+		return p.stub(ctx, p.Command, in.iter)
+	}
+	if err := in.start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- in.wait()
+	}()
+
+	select {
+	case err := <-done:
+		return p.captured(in, err)
+	case <-ctx.Done():
 	}
+	interrupt(in.cmd.Process)
+	timer := time.NewTimer(killTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		in.cmd.Process.Kill()
+		<-done
+	}
+	return ctx.Err()
+}
+
+// captured keeps the captured output of a finished run and, if it failed, adds it to err.
+func (p *Process) captured(in *instance, err error) error {
+	if in.capture == nil {
+		return err
+	}
+	out := in.capture.Bytes()
+	p.mu.Lock()
+	p.output = out
+	p.mu.Unlock()
+	if err == nil || len(out) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w, output:\n%s", err, bytes.TrimRight(out, "\n"))
+}
+
+// Output returns the output captured by !capture during the last finished run.
+func (p *Process) Output() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.output
 }
 
-func (p *Process) _monotonicTimesRunFunc() {
-	p.Run = func() (err error) {
-		defer p.Kill()
-		ticker := time.NewTicker(p.Command.Every)
-		defer ticker.Stop()
-		done := make(chan error, 5)
-		run := func() {
-			done <- p.Cmd.Run()
+func (p *Process) runTimes(ctx context.Context) error {
+	for i := 0; i < p.Command.Times; i++ {
+		if err := p.runOnce(ctx); err != nil {
+			return err
 		}
-		go func() {
-			for i := 0; i < p.Command.Times; i++ {
-				go run()
-				select {
-				case <-ticker.C:
-					p.Refresh()
-				case err = <-done:
-					if err != nil {
-						p.LogError(err)
-						return
-					}
-					p.Refresh()
-				}
-			}
-		}()
-		return
 	}
+	return nil
 }
 
-func (p *Process) monotonicTimesRunFunc() {
-	p.Run = func() (err error) {
-		defer p.Kill()
-		for i := 0; i < p.Command.Times; i++ {
-			err = p.Cmd.Run()
-			if err != nil {
-				return
+// runEvery runs the command on ticks of p.Command.Every, aligned to the wall clock
+// so that the schedule doesn't drift by the runtime of the command.
+// The first run starts immediately.
+// Every run, including the first, is delayed by the jitter:= and splay:= offsets.
+// If a tick arrives while a previous run is still going, p.Command.Overlap decides what happens.
+// Skipped ticks do not count towards p.Command.Times.
+func (p *Process) runEvery(ctx context.Context) error {
+	var (
+		times     = p.Command.Times
+		started   int
+		running   int
+		queued    int
+		failed    error
+		cancelRun context.CancelFunc
+	)
+	finished := make(chan error)
+	// how many runs are done but not yet received from finished
+	var unreceived int32
+	start := func() {
+		runCtx, cancel := context.WithCancel(ctx)
+		cancelRun = cancel
+		started++
+		running++
+		in, err := p.take()
+		spawn(p.clock, func() {
+			if err == nil {
+				err = p.exec(runCtx, in)
 			}
-			if i+1 == p.Command.Times {
+			cancel()
+			// a run stopped by a newer one (overlap:= replace) isn't a failure
+			if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+				err = nil
+			}
+			atomic.AddInt32(&unreceived, 1)
+			finished <- err
+		})
+	}
+	pending := func() bool {
+		return times == 0 || started+queued < times
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tick := p.clock.Now()
+	timer := p.clock.NewTimer(p.offset())
+	defer timer.Stop()
+	ticking := true
+
+	for running > 0 || queued > 0 || (ticking && failed == nil) {
+		w := waiting(p.clock, timer, func() bool {
+			return ctx.Err() != nil || atomic.LoadInt32(&unreceived) > 0
+		})
+		select {
+		case <-ctx.Done():
+			w.done()
+			// wait for the running children to be stopped
+			queued = 0
+			ticking = false
+			for ; running > 0; running-- {
+				<-finished
+				atomic.AddInt32(&unreceived, -1)
+			}
+		case err := <-finished:
+			w.done()
+			atomic.AddInt32(&unreceived, -1)
+			running--
+			if err != nil && failed == nil {
+				failed = err
+				queued = 0
+				// stop the other runs, if any
+				cancel()
+			}
+			if queued > 0 && failed == nil {
+				queued--
+				start()
+			}
+		case <-timer.C():
+			w.done()
+			if failed != nil || ctx.Err() != nil {
 				break
 			}
-			time.Sleep(p.Command.Every)
-			p.Refresh()
+			switch {
+			case running == 0:
+				start()
+			case p.Command.Overlap == ast.OverlapQueue:
+				queued++
+			case p.Command.Overlap == ast.OverlapParallel:
+				start()
+			case p.Command.Overlap == ast.OverlapReplace:
+				cancelRun()
+				start()
+			}
+			ticking = pending()
+			if ticking {
+				now := p.clock.Now()
+				tick = nextTick(tick, p.Command.Every)
+				if tick.Before(now) {
+					tick = nextTick(now, p.Command.Every)
+				}
+				timer.Reset(tick.Add(p.offset()).Sub(p.clock.Now()))
+			}
 		}
-		return
 	}
+
+	if failed != nil {
+		return failed
+	}
+	return ctx.Err()
 }
 
-func (p *Process) monotonicRunFunc() {
-	p.Run = func() error {
-		defer p.Kill()
-		for {
-			err := p.Cmd.Run()
-			if err != nil {
-				return err
-			}
-			p.Refresh()
-			time.Sleep(p.Command.Every)
+// nextTick returns the first tick of a schedule with the given interval that comes after t.
+// Ticks are aligned to the wall clock: an interval of a minute ticks at the start of every minute.
+// Intervals of a day or more are aligned to midnight in the time zone of t, and weeks to mondays.
+func nextTick(t time.Time, every time.Duration) time.Time {
+	if every < 24*time.Hour {
+		return t.Truncate(every).Add(every)
+	}
+	// the wall clock time of t is truncated as if it were in UTC, whose days are all as long
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	for next := wall.Truncate(every).Add(every); ; next = next.Add(every) {
+		tick := time.Date(next.Year(), next.Month(), next.Day(), next.Hour(), next.Minute(), next.Second(), next.Nanosecond(), t.Location())
+		// a tick in the hour repeated when daylight saving time ends may come before t
+		if tick.After(t) {
+			return tick
 		}
 	}
 }
+
+// sleep pauses for d on the given clock or until ctx is cancelled, whichever comes first.
+func sleep(ctx context.Context, clock Clock, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+	w := waiting(clock, timer, func() bool {
+		return ctx.Err() != nil
+	})
+	defer w.done()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+func interrupt(pr *os.Process) {
+	// process.Signal(sigint) does nothing on windows so we kill instead
+	if os.PathSeparator == '\\' {
+		pr.Kill()
+	} else {
+		pr.Signal(os.Interrupt)
+	}
+}
@@ -0,0 +1,1266 @@
+package runtime
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/insomnimus/inscript/ast"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newProcess(t *testing.T, cmd *ast.Command) *Process {
+	t.Helper()
+	if _, err := exec.LookPath(cmd.Command); err != nil {
+		t.Skipf("%s not found in PATH", cmd.Command)
+	}
+	p, err := CreateProcess(cmd)
+	if err != nil {
+		t.Fatalf("CreateProcess returned error: %s", err)
+	}
+	return p
+}
+
+func TestRun(t *testing.T) {
+	p := newProcess(t, &ast.Command{Command: "true", Sync: true})
+	if err := p.Run(context.Background()); err != nil {
+		t.Errorf("Run returned error: %s", err)
+	}
+	if !p.Killed() {
+		t.Errorf("expected the process to be marked killed after Run returned")
+	}
+
+	p = newProcess(t, &ast.Command{Command: "false", Sync: true})
+	if err := p.Run(context.Background()); err == nil {
+		t.Errorf("expected Run to return the exit error of the command")
+	}
+}
+
+func TestRunTimes(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.txt")
+	p := newProcess(t, &ast.Command{
+		Command: "echo",
+		Args:    []string{"hello"},
+		Stdout:  []ast.Redirect{{Target: out}},
+		Sync:    true,
+		Times:   3,
+	})
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned error: %s", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(data), "hello\n"); got != 3 {
+		t.Errorf("expected 3 runs, got %d:\n%s", got, data)
+	}
+}
+
+func TestCancelInterruptsSleep(t *testing.T) {
+	p := newProcess(t, &ast.Command{
+		Command: "true",
+		Every:   time.Hour,
+		Times:   2,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := p.Run(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Run took %s to return after cancellation", elapsed)
+	}
+}
+
+func TestKillStopsChild(t *testing.T) {
+	p := newProcess(t, &ast.Command{Command: "sleep", Args: []string{"30"}})
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(context.Background())
+	}()
+	time.Sleep(100 * time.Millisecond)
+	p.Kill()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %s, got %v", context.Canceled, err)
+		}
+	case <-time.After(killTimeout + 5*time.Second):
+		t.Fatal("Run did not return after Kill")
+	}
+}
+
+func TestKillBeforeRun(t *testing.T) {
+	p := newProcess(t, &ast.Command{Command: "sleep", Args: []string{"30"}})
+	p.Kill()
+	if err := p.Run(context.Background()); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %s, got %v", context.Canceled, err)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	p := newProcess(t, &ast.Command{
+		Command: "true",
+		Every:   10 * time.Millisecond,
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(context.Background())
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				p.Killed()
+				p.Cmd()
+				p.Refresh()
+				time.Sleep(time.Millisecond)
+			}
+			p.Kill()
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-done:
+	case <-time.After(killTimeout + 5*time.Second):
+		t.Fatal("Run did not return after Kill")
+	}
+}
+
+func TestNextTick(t *testing.T) {
+	base := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	// days start at midnight and weeks on mondays in the time zone of the time
+	plus2 := time.FixedZone("UTC+2", 2*60*60)
+	tue := time.Date(2021, 6, 1, 12, 0, 0, 0, plus2)
+	tests := []struct {
+		now   time.Time
+		every time.Duration
+		want  time.Time
+	}{
+		{base, time.Minute, base.Add(time.Minute)},
+		{base.Add(20 * time.Second), time.Minute, base.Add(time.Minute)},
+		{base.Add(59*time.Second + 999*time.Millisecond), time.Minute, base.Add(time.Minute)},
+		{base.Add(61 * time.Second), time.Minute, base.Add(2 * time.Minute)},
+		{base.Add(10 * time.Minute), time.Hour, base.Add(time.Hour)},
+		{tue, 24 * time.Hour, time.Date(2021, 6, 2, 0, 0, 0, 0, plus2)},
+		{tue, 7 * 24 * time.Hour, time.Date(2021, 6, 7, 0, 0, 0, 0, plus2)},
+		{time.Date(2021, 6, 2, 0, 0, 0, 0, plus2), 24 * time.Hour, time.Date(2021, 6, 3, 0, 0, 0, 0, plus2)},
+	}
+	for _, test := range tests {
+		if got := nextTick(test.now, test.every); !got.Equal(test.want) {
+			t.Errorf("nextTick(%s, %s): expected %s, got %s", test.now, test.every, test.want, got)
+		}
+	}
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	// the day daylight saving time starts on is an hour shorter
+	now := time.Date(2021, 3, 28, 0, 0, 0, 0, berlin)
+	if got, want := nextTick(now, 24*time.Hour), time.Date(2021, 3, 29, 0, 0, 0, 0, berlin); !got.Equal(want) {
+		t.Errorf("nextTick(%s, 24h): expected %s, got %s", now, want, got)
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found in PATH")
+	}
+	// every run takes 500ms and a new one is due every 100ms
+	tests := []struct {
+		overlap  ast.Overlap
+		min, max time.Duration
+	}{
+		{ast.OverlapSkip, 1200 * time.Millisecond, 3 * time.Second},
+		{ast.OverlapQueue, 1400 * time.Millisecond, 3 * time.Second},
+		{ast.OverlapParallel, 500 * time.Millisecond, 1200 * time.Millisecond},
+		{ast.OverlapReplace, 500 * time.Millisecond, 1200 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.overlap.String(), func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out.txt")
+			p := newProcess(t, &ast.Command{
+				Command: "sh",
+				Args:    []string{"-c", "echo start; exec sleep 0.5"},
+				Stdout:  []ast.Redirect{{Target: out}},
+				Every:   100 * time.Millisecond,
+				Times:   3,
+				Overlap: test.overlap,
+			})
+			start := time.Now()
+			if err := p.Run(context.Background()); err != nil {
+				t.Fatalf("Run returned error: %s", err)
+			}
+			elapsed := time.Since(start)
+			if elapsed < test.min || elapsed > test.max {
+				t.Errorf("expected Run to take between %s and %s, took %s", test.min, test.max, elapsed)
+			}
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Count(string(data), "start\n"); got != 3 {
+				t.Errorf("expected 3 runs, got %d", got)
+			}
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	const max = time.Minute
+	Seed(42)
+	first := make([]time.Duration, 10)
+	for i := range first {
+		first[i] = jitter(max)
+		if first[i] < 0 || first[i] >= max {
+			t.Errorf("jitter(%s) returned %s, out of range", max, first[i])
+		}
+	}
+	Seed(42)
+	for i, want := range first {
+		if got := jitter(max); got != want {
+			t.Errorf("jitter is not reproducible after Seed: run %d: expected %s, got %s", i, want, got)
+		}
+	}
+	if d := jitter(0); d != 0 {
+		t.Errorf("expected jitter(0) to be 0, got %s", d)
+	}
+}
+
+func TestSplay(t *testing.T) {
+	cmd := &ast.Command{Command: "backup", Name: "nightly", Splay: time.Hour}
+	a := splay("host-a", cmd)
+	if a < 0 || a >= time.Hour {
+		t.Errorf("splay returned %s, out of range", a)
+	}
+	if again := splay("host-a", cmd); again != a {
+		t.Errorf("splay is not stable: %s != %s", a, again)
+	}
+	differs := false
+	for _, host := range []string{"host-b", "host-c", "host-d"} {
+		if splay(host, cmd) != a {
+			differs = true
+		}
+	}
+	if !differs {
+		t.Errorf("expected different hosts to get different offsets")
+	}
+	if d := splay("host-a", &ast.Command{Command: "backup"}); d != 0 {
+		t.Errorf("expected no offset without splay:=, got %s", d)
+	}
+}
+
+func TestLimiterOrder(t *testing.T) {
+	l := NewLimiter(1, nil)
+	ctx := context.Background()
+	release, err := l.Acquire(ctx, "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waiters := []struct {
+		seq, priority int
+	}{{3, 0}, {1, 0}, {4, 5}, {2, 0}}
+	var (
+		mux   sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for _, w := range waiters {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := l.Acquire(ctx, "", w.priority, w.seq)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mux.Lock()
+			order = append(order, w.seq)
+			mux.Unlock()
+			release()
+		}()
+	}
+	// let every waiter queue up
+	for {
+		l.mux.Lock()
+		n := len(l.waiting)
+		l.mux.Unlock()
+		if n == len(waiters) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	wg.Wait()
+
+	want := []int{4, 1, 2, 3}
+	for i := range want {
+		if i >= len(order) || order[i] != want[i] {
+			t.Fatalf("expected commands to run in order %v, got %v", want, order)
+		}
+	}
+}
+
+func TestLimiterPools(t *testing.T) {
+	l := NewLimiter(2, map[string]int{"db": 1})
+	ctx := context.Background()
+	release, err := l.Acquire(ctx, "db", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pool is full
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(short, "db", 0, 1); err == nil {
+		t.Errorf("expected a second command in a pool of 1 to wait")
+	}
+	// but there's room in total
+	other, err := l.Acquire(ctx, "", 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+	release()
+	release, err = l.Acquire(ctx, "db", 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	if l.running != 0 || l.inPool["db"] != 0 || len(l.waiting) != 0 {
+		t.Errorf("expected the limiter to be empty, got running=%d inPool=%v waiting=%d", l.running, l.inPool, len(l.waiting))
+	}
+}
+
+func TestRunnerMaxParallel(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not found in PATH")
+	}
+	cmds := []*ast.Command{
+		{Command: "sleep", Args: []string{"0.3"}},
+		{Command: "sleep", Args: []string{"0.3"}},
+		{Command: "sleep", Args: []string{"0.3"}, Sync: true},
+	}
+	start := time.Now()
+	if err := NewRunner(ast.Settings{MaxParallel: 1}).Run(context.Background(), cmds); err != nil {
+		t.Fatalf("Run returned error: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("expected the commands to run one at a time, took %s", elapsed)
+	}
+}
+
+func TestRunnerError(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not found in PATH")
+	}
+	cmds := []*ast.Command{
+		{Command: "sleep", Args: []string{"30"}},
+		{Command: "false", Name: "failing", Sync: true},
+	}
+	start := time.Now()
+	err := NewRunner(ast.Settings{}).Run(context.Background(), cmds)
+	if err == nil || !strings.HasPrefix(err.Error(), "command failing:") {
+		t.Errorf("expected the error of the failing command, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > killTimeout+5*time.Second {
+		t.Errorf("expected the other commands to be stopped, took %s", elapsed)
+	}
+}
+
+func TestLock(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not found in PATH")
+	}
+	cmds := []*ast.Command{
+		{Command: "sleep", Args: []string{"0.3"}, Lock: "db"},
+		{Command: "sleep", Args: []string{"0.3"}, Lock: "db"},
+		{Command: "sleep", Args: []string{"0.3"}, Lock: "other"},
+	}
+	start := time.Now()
+	if err := NewRunner(ast.Settings{}).Run(context.Background(), cmds); err != nil {
+		t.Fatalf("Run returned error: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Errorf("expected only the commands sharing a lock to be serialised, took %s", elapsed)
+	}
+}
+
+func TestFlockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+	f, err := flockFile(context.Background(), path)
+	if errors.Is(err, errFlockUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*flockInterval)
+	defer cancel()
+	if g, err := flockFile(ctx, path); err == nil {
+		g.Close()
+		t.Fatal("expected the lock file to be busy")
+	}
+
+	f.Close()
+	g, err := flockFile(context.Background(), path)
+	if err != nil {
+		t.Fatalf("expected the lock to be free after closing the file: %s", err)
+	}
+	g.Close()
+}
+
+func TestLockScript(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "test.ins")
+	ctx := context.Background()
+	release, err := LockScript(ctx, script, ast.SingletonExit)
+	if errors.Is(err, errFlockUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockScript(ctx, script, ast.SingletonExit); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected %s, got %v", ErrLocked, err)
+	}
+	path, err := LockPath(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, pid, err := tryLockScript(ctx, path); f != nil || err != nil || pid != os.Getpid() {
+		t.Errorf("expected the pid of the holder to be recorded, got %d (%v)", pid, err)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 3*flockInterval)
+	defer cancel()
+	if _, err := LockScript(short, script, ast.SingletonWait); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the second instance to wait, got %v", err)
+	}
+
+	release()
+	release, err = LockScript(ctx, script, ast.SingletonExit)
+	if err != nil {
+		t.Fatalf("expected the lock to be free after release: %s", err)
+	}
+	release()
+	if data, err := os.ReadFile(pidPath(path)); err != nil || len(data) > 0 {
+		t.Errorf("expected %s to be cleared on release, got %q (%v)", pidPath(path), data, err)
+	}
+}
+
+func TestRedirectModes(t *testing.T) {
+	dir := t.TempDir()
+	run := func(cmd *ast.Command) {
+		t.Helper()
+		p := newProcess(t, cmd)
+		if err := p.Run(context.Background()); err != nil {
+			t.Fatalf("Run returned error: %s", err)
+		}
+	}
+	read := func(path string) string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	truncate := filepath.Join(dir, "truncate.txt")
+	if err := os.WriteFile(truncate, []byte("some long garbage from an earlier run\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run(&ast.Command{Command: "echo", Args: []string{"new"}, Stdout: []ast.Redirect{{Target: truncate}}, Times: 2})
+	if got := read(truncate); got != "new\nnew\n" {
+		t.Errorf("expected the file to be truncated once, got %q", got)
+	}
+	// a later process truncates it again
+	run(&ast.Command{Command: "echo", Args: []string{"again"}, Stdout: []ast.Redirect{{Target: truncate}}})
+	if got := read(truncate); got != "again\n" {
+		t.Errorf("expected the file to be truncated by the next process, got %q", got)
+	}
+
+	appended := filepath.Join(dir, "append.txt")
+	if err := os.WriteFile(appended, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run(&ast.Command{Command: "echo", Args: []string{"new"}, Stdout: []ast.Redirect{{Target: appended, Append: true}}})
+	if got := read(appended); got != "old\nnew\n" {
+		t.Errorf("expected the output to be appended, got %q", got)
+	}
+
+	created := filepath.Join(dir, "created.txt")
+	run(&ast.Command{Command: "echo", Stdout: []ast.Redirect{{Target: created}}, FileMode: 0600})
+	info, err := os.Stat(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.PathSeparator != '\\' && info.Mode().Perm() != 0600 {
+		t.Errorf("expected the file to be created with mode 0600, got %#o", info.Mode().Perm())
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip(err)
+	}
+	base := filepath.FromSlash("/scripts")
+	if abs, err := filepath.Abs(base); err == nil {
+		base = abs
+	}
+	tmp := filepath.Join(base, "..", "tmp")
+	tests := []struct {
+		dir, path, want string
+	}{
+		{"", "out.txt", filepath.Join(base, "out.txt")},
+		{tmp, "out.txt", filepath.Join(tmp, "out.txt")},
+		{tmp, "./logs/../out.txt", filepath.Join(tmp, "out.txt")},
+		{tmp, filepath.Join(base, "out.txt"), filepath.Join(base, "out.txt")},
+		{"", "~/out.txt", filepath.Join(home, "out.txt")},
+	}
+	for _, test := range tests {
+		got, err := resolvePath(base, test.dir, test.path)
+		if err != nil {
+			t.Errorf("resolvePath(%q, %q, %q) returned error: %s", base, test.dir, test.path, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("resolvePath(%q, %q, %q): expected %q, got %q", base, test.dir, test.path, test.want, got)
+		}
+	}
+}
+
+func TestSharedRedirectFile(t *testing.T) {
+	dir := t.TempDir()
+	cmds := []*ast.Command{
+		{Command: "echo", Args: []string{"one"}, Stdout: []ast.Redirect{{Target: "out.txt"}}, Sync: true},
+		{Command: "echo", Args: []string{"two"}, Stdout: []ast.Redirect{{Target: "./sub/../out.txt"}}, Sync: true, Mkdir: true},
+		{Command: "echo", Args: []string{"three"}, Dir: dir, Stdout: []ast.Redirect{{Target: "out.txt"}}, Sync: true},
+	}
+	r := NewRunner(ast.Settings{})
+	r.Dir = dir
+	if err := r.Run(context.Background(), cmds); err != nil {
+		t.Fatalf("Run returned error: %s", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != "one\ntwo\nthree\n" {
+		t.Errorf("expected every command to write to the same file, got %q", got)
+	}
+}
+
+func TestTee(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "all.log"), []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "build.log"), []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmds := []*ast.Command{{
+		Command: "echo",
+		Args:    []string{"new"},
+		Stdout:  []ast.Redirect{{Target: "build.log"}, {Target: "all.log", Append: true}},
+		Sync:    true,
+	}}
+	r := NewRunner(ast.Settings{})
+	r.Dir = dir
+	if err := r.Run(context.Background(), cmds); err != nil {
+		t.Fatalf("Run returned error: %s", err)
+	}
+	for name, want := range map[string]string{
+		"build.log": "new\n",
+		"all.log":   "old\nnew\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(data); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found in PATH")
+	}
+	p, err := CreateProcess(&ast.Command{
+		Command: "sh",
+		Args:    []string{"-c", "echo out; sleep 0.05; echo err >&2; exit 3"},
+		Stdin:   "!null",
+		Stdout:  []ast.Redirect{{Target: "!capture"}, {Target: "!null"}},
+		Stderr:  []ast.Redirect{{Target: "!capture"}},
+		Sync:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Run(context.Background())
+	if err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	if !strings.Contains(err.Error(), "out\nerr") {
+		t.Errorf("expected the error to contain the output, got %q", err)
+	}
+	if got := string(p.Output()); got != "out\nerr\n" {
+		t.Errorf("expected the output to be captured, got %q", got)
+	}
+
+	if _, err := CreateProcess(&ast.Command{Command: "cat", Stdin: "!capture"}); err == nil {
+		t.Error("expected an error for !capture as stdin")
+	}
+}
+
+func TestInput(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.txt")
+	p := newProcess(t, &ast.Command{
+		Command: "cat",
+		Input:   "line\n",
+		Stdout:  []ast.Redirect{{Target: out}},
+		Times:   2,
+		Sync:    true,
+	})
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != "line\nline\n" {
+		t.Errorf("expected every run to read the input, got %q", got)
+	}
+}
+
+func TestJobStreams(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found in PATH")
+	}
+	dir := t.TempDir()
+	cmds := []*ast.Command{
+		{Command: "cat", Stdin: "@producer", Stdout: []ast.Redirect{{Target: "out.txt"}}},
+		{Command: "sh", Args: []string{"-c", "echo one; echo two"}, Name: "producer"},
+		{Command: "sh", Args: []string{"-c", "echo three"}, Stdout: []ast.Redirect{{Target: "@consumer"}}},
+		{Command: "sort", Name: "consumer", Stdout: []ast.Redirect{{Target: "sorted.txt"}}, Sync: true},
+	}
+	r := NewRunner(ast.Settings{})
+	r.Dir = dir
+	if err := r.Run(context.Background(), cmds); err != nil {
+		t.Fatalf("Run returned error: %s", err)
+	}
+	for name, want := range map[string]string{
+		"out.txt":    "one\ntwo\n",
+		"sorted.txt": "three\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(data); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+
+	for _, cmds := range [][]*ast.Command{
+		{{Command: "cat", Stdin: "@missing"}},
+		{{Command: "cat", Stdin: "@job"}, {Command: "echo", Name: "job"}, {Command: "echo", Name: "job"}},
+		{{Command: "cat", Stdin: "@job", Sync: true}, {Command: "echo", Name: "job"}},
+		{{Command: "echo", Name: "job", Stdout: []ast.Redirect{{Target: "@job"}}}},
+		{{Command: "cat", Name: "job", Stdin: "in.txt"}, {Command: "echo", Stdout: []ast.Redirect{{Target: "@job"}}}},
+	} {
+		if err := NewRunner(ast.Settings{}).Run(context.Background(), cmds); err == nil {
+			t.Errorf("expected an error for %#v", cmds[0])
+		}
+	}
+	if _, err := CreateProcess(&ast.Command{Command: "cat", Stdin: "@job"}); err == nil {
+		t.Error("expected an error for a job reference outside of a script")
+	}
+}
+
+func TestStream(t *testing.T) {
+	s := newStream()
+	s.writers = 1
+	stop := make(chan struct{})
+	buf := make([]byte, 4)
+
+	s.Write([]byte("abcdef"))
+	if n, err := s.read(buf, stop); err != nil || string(buf[:n]) != "abcd" {
+		t.Errorf("expected to read \"abcd\", got %q, %v", buf[:n], err)
+	}
+	s.Write(make([]byte, maxStream))
+	if n, _ := s.read(buf, stop); n != 4 || buf[0] != 0 {
+		t.Errorf("expected the oldest output to be dropped, got %q", buf[:n])
+	}
+
+	s = newStream()
+	s.writers = 1
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(stop)
+	}()
+	if _, err := s.read(buf, stop); err != errStopped {
+		t.Errorf("expected the read to be stopped, got %v", err)
+	}
+	s.Write([]byte("last"))
+	s.done()
+	if n, err := s.read(buf, nil); err != nil || string(buf[:n]) != "last" {
+		t.Errorf("expected to read what's left after the writers are done, got %q, %v", buf[:n], err)
+	}
+	if _, err := s.read(buf, nil); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+
+	s = newStream()
+	s.writers = 1
+	s.close()
+	s.Write([]byte("discarded"))
+	if _, err := s.read(buf, nil); err != io.EOF {
+		t.Errorf("expected a closed stream to discard what's written, got %v", err)
+	}
+}
+
+func TestDecorator(t *testing.T) {
+	var buf strings.Builder
+	d := newDecorator(&buf, &ast.Command{Prefix: "job", Timestamps: ast.TimestampsElapsed})
+	d.start = time.Now()
+	d.Write([]byte("one\ntw"))
+	d.Write([]byte("o\n\nthree"))
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got %q", buf.String())
+	}
+	for i, want := range []string{"job | one", "job | two", "job | ", "job | three"} {
+		if !strings.HasSuffix(lines[i], "s "+want) || !strings.HasPrefix(strings.TrimSpace(lines[i]), "0.0") {
+			t.Errorf("line %d: expected an elapsed timestamp followed by %q, got %q", i, want, lines[i])
+		}
+	}
+
+	if d := newDecorator(&buf, &ast.Command{}); d != nil {
+		t.Error("expected no decorator for a command without prefix:= or timestamps:=")
+	}
+}
+
+func TestPrefixOutput(t *testing.T) {
+	dir := t.TempDir()
+	cmds := []*ast.Command{
+		{Command: "echo", Args: []string{"one"}, Prefix: "first", Stdout: []ast.Redirect{{Target: "out.txt"}, {Target: "@raw"}}},
+		{Command: "cat", Name: "raw", Stdout: []ast.Redirect{{Target: "raw.txt"}}},
+	}
+	r := NewRunner(ast.Settings{})
+	r.Dir = dir
+	if err := r.Run(context.Background(), cmds); err != nil {
+		t.Fatalf("Run returned error: %s", err)
+	}
+	for name, want := range map[string]string{
+		"out.txt": "first | one\n",
+		"raw.txt": "one\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(data); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestSharedFileLines(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found in PATH")
+	}
+	dir := t.TempDir()
+	script := func(a, b string) []string {
+		return []string{"-c", `i=0; while [ $i -lt 50 ]; do printf ` + a + `; sleep 0.01; printf '` + b + `\n'; i=$((i+1)); done`}
+	}
+	cmds := []*ast.Command{
+		{Command: "sh", Args: script("aaaa", "bbbb"), Stdout: []ast.Redirect{{Target: "out.txt"}}},
+		{Command: "sh", Args: script("cccc", "dddd"), Stdout: []ast.Redirect{{Target: "out.txt"}}},
+		{Command: "sh", Args: script("eeee", "ffff"), Stdout: []ast.Redirect{{Target: "out.txt"}}, Stderr: []ast.Redirect{{Target: "out.txt"}}},
+	}
+	r := NewRunner(ast.Settings{})
+	r.Dir = dir
+	if err := r.Run(context.Background(), cmds); err != nil {
+		t.Fatalf("Run returned error: %s", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 150 {
+		t.Errorf("expected 150 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		switch line {
+		case "aaaabbbb", "ccccdddd", "eeeeffff":
+		default:
+			t.Fatalf("found a mixed up line: %q", line)
+		}
+	}
+}
+
+func TestFileRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.txt")
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				f, err := OpenFile(path, true, 0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				f.Write([]byte("line\n"))
+				f.Done()
+			}
+		}()
+	}
+	wg.Wait()
+	if _, ok := LookupFile(path); ok {
+		t.Errorf("expected the file to be removed from the registry after its last user was done")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "line\n"); n != 16*50 {
+		t.Errorf("expected %d lines, got %d", 16*50, n)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.log")
+	f, err := OpenFile(path, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.rotateBy(ast.Rotation{Size: 10, Keep: 2, Compress: true})
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Done()
+
+	read := func(path string, gz bool) string {
+		t.Helper()
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		var r io.Reader = file
+		if gz {
+			if r, err = gzip.NewReader(file); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	if got := read(path, false); got != "fourth\n" {
+		t.Errorf("expected the current file to hold the last line, got %q", got)
+	}
+	if got := read(path+".1.gz", true); got != "third\n" {
+		t.Errorf("expected %s.1.gz to hold the previous line, got %q", path, got)
+	}
+	if got := read(path+".2.gz", true); got != "second\n" {
+		t.Errorf("expected %s.2.gz to hold the line before, got %q", path, got)
+	}
+	for _, name := range []string{path + ".3.gz", path + ".1", path + ".2"} {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("expected %s not to exist", name)
+		}
+	}
+
+	// daily rotation, keeping every file
+	path = filepath.Join(dir, "daily.log")
+	if f, err = OpenFile(path, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.rotateBy(ast.Rotation{Daily: true})
+	for i := 0; i < 3; i++ {
+		f.Write([]byte("line\n"))
+		f.mux.Lock()
+		f.last = f.last.AddDate(0, 0, -1)
+		f.mux.Unlock()
+	}
+	f.Done()
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if got := read(name, false); got != "line\n" {
+			t.Errorf("%s: expected a line a day, got %q", name, got)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found in PATH")
+	}
+	dir := t.TempDir()
+	day := time.Now().Format("20060102")
+	cmds := []*ast.Command{
+		{
+			Command: "sh",
+			Args:    []string{"-c", "echo $INSCRIPT_ITER $INSCRIPT_JOB"},
+			Name:    "job",
+			Stdout:  []ast.Redirect{{Target: `{{.Name}}-{{.Iter}}-{{.Time "20060102"}}.log`}, {Target: "all.log"}},
+			Times:   2,
+			Sync:    true,
+		},
+		{
+			Command: "pwd",
+			Dir:     filepath.Join(dir, "run-{{.Iter}}"),
+			Stdout:  []ast.Redirect{{Target: "pwd.txt"}},
+			Mkdir:   true,
+			Times:   2,
+			Sync:    true,
+		},
+	}
+	r := NewRunner(ast.Settings{})
+	r.Dir = dir
+	if err := r.Run(context.Background(), cmds); err != nil {
+		t.Fatalf("Run returned error: %s", err)
+	}
+	for name, want := range map[string]string{
+		"job-1-" + day + ".log": "1 job\n",
+		"job-2-" + day + ".log": "2 job\n",
+		"all.log":               "1 job\n2 job\n",
+		"run-1/pwd.txt":         filepath.Join(dir, "run-1") + "\n",
+		"run-2/pwd.txt":         filepath.Join(dir, "run-2") + "\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got := string(data); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+
+	if _, err := CreateProcess(&ast.Command{Command: "echo", Stdout: []ast.Redirect{{Target: "{{.Name"}}}); err == nil {
+		t.Error("expected an error for an invalid template")
+	}
+	p := newProcess(t, &ast.Command{Command: "echo", Stdout: []ast.Redirect{{Target: filepath.Join(dir, "{{.Missing}}")}}})
+	if err := p.Run(context.Background()); err == nil {
+		t.Error("expected an error for a template that can't be evaluated")
+	}
+
+	// the files of a run whose stdin can't be opened are released
+	p = newProcess(t, &ast.Command{
+		Command: "echo",
+		Stdin:   filepath.Join(dir, "all.log", "in.txt"),
+		Stdout:  []ast.Redirect{{Target: filepath.Join(dir, "{{.Iter}}-failed.log")}},
+	})
+	if err := p.Run(context.Background()); err == nil {
+		t.Error("expected an error for a stdin file that can't be opened")
+	}
+	if _, ok := LookupFile(filepath.Join(dir, "1-failed.log")); ok {
+		t.Error("expected the file of the failed run to be released")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	cmds := []*ast.Command{
+		{Command: "echo", Args: []string{"$(date)"}, Stdout: []ast.Redirect{{Target: "out.log"}, {Target: "all.log", Append: true}}, Sync: true},
+		{Command: "date", Dir: dir, Every: time.Minute, Times: 3, Stdout: []ast.Redirect{{Target: "{{.Iter}}.log"}}},
+	}
+	r := NewRunner(ast.Settings{})
+	r.Dir = dir
+	var buf strings.Builder
+	if err := r.DryRun(&buf, cmds); err != nil {
+		t.Fatalf("DryRun returned error: %s", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		`argv:     ["echo" "$(date)"]`,
+		"mode:     sync",
+		"stdout:   " + filepath.Join(dir, "out.log") + ", >> " + filepath.Join(dir, "all.log"),
+		"mode:     async",
+		"schedule: every 1m0s, 3 times, overlap skip",
+		"stdout:   {{.Iter}}.log (per run)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected the plan to contain %q, got:\n%s", want, out)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		t.Errorf("expected a dry run not to create any files, found %d", len(entries))
+	}
+
+	if err := r.DryRun(&buf, []*ast.Command{{Command: "cat", Stdin: "@missing"}}); err == nil {
+		t.Error("expected an error for a reference to a missing job")
+	}
+}
+
+func TestSimClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewSimClock(start)
+	a := c.NewTimer(2 * time.Second)
+	b := c.NewTimer(time.Second)
+	stopped := c.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Error("expected Stop to report an armed timer")
+	}
+	if next, ok := c.Next(); !ok || !next.Equal(start.Add(time.Second)) {
+		t.Fatalf("expected the next timer at 1s, got %s, %t", next, ok)
+	}
+	c.Step(start.Add(time.Second))
+	select {
+	case <-b.C():
+	default:
+		t.Error("expected the 1s timer to fire")
+	}
+	select {
+	case <-a.C():
+		t.Error("expected the 2s timer not to fire yet")
+	case <-stopped.C():
+		t.Error("expected the stopped timer not to fire")
+	default:
+	}
+	a.Reset(time.Minute)
+	if next, _ := c.Next(); !next.Equal(start.Add(time.Second + time.Minute)) {
+		t.Errorf("expected a reset timer to count from the current time, got %s", next)
+	}
+	c.Step(start.Add(time.Hour))
+	if got := c.Now(); !got.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected the time to be %s, got %s", start.Add(time.Hour), got)
+	}
+	if _, ok := c.Next(); ok {
+		t.Error("expected no armed timers")
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	cmds := []*ast.Command{
+		{Command: "report", Name: "report", Every: 4 * time.Hour, Overlap: ast.OverlapQueue},
+		{Command: "backup", Name: "backup", Every: 6 * time.Hour, LockFile: "backup.lock", Stdout: []ast.Redirect{{Target: "backup.log"}}},
+	}
+	durations := map[string]time.Duration{"report": 3 * time.Hour, "backup": time.Hour}
+	r := NewRunner(ast.Settings{})
+	r.Dir = dir
+	events, err := r.Simulate(cmds, start, 24*time.Hour, func(cmd *ast.Command) time.Duration {
+		return durations[cmd.Name]
+	})
+	if err != nil {
+		t.Fatalf("Simulate returned error: %s", err)
+	}
+
+	starts := make(map[string][]time.Duration)
+	for _, e := range events {
+		if e.Start {
+			starts[e.Job] = append(starts[e.Job], e.Time.Sub(start))
+		}
+	}
+	h := time.Hour
+	// the queued ticks of report at 12:00 and 16:00 wait for the runs before them
+	want := map[string][]time.Duration{
+		"report": {0, 3 * h, 7 * h, 11 * h, 15 * h, 19 * h, 23 * h},
+		"backup": {0, 3 * h, 9 * h, 15 * h, 21 * h},
+	}
+	for job, w := range want {
+		if !reflect.DeepEqual(starts[job], w) {
+			t.Errorf("expected %s to start at %v, got %v", job, w, starts[job])
+		}
+	}
+
+	last := events[len(events)-1]
+	if last.Start || !last.Stopped || last.Job != "report" || !last.Time.Equal(start.Add(24*h)) {
+		t.Errorf("expected the last run of report to be stopped at the end, got %+v", last)
+	}
+	for _, e := range events {
+		if e.Start && e.Job == "backup" && e.Time.Equal(start.Add(9*h)) {
+			if !reflect.DeepEqual(e.Running, []string{"report (run 3)"}) {
+				t.Errorf("expected backup to overlap report (run 3) at 9h, got %v", e.Running)
+			}
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		t.Errorf("expected a simulation not to create any files, found %d", len(entries))
+	}
+
+	var buf strings.Builder
+	WriteSimulation(&buf, start, events)
+	for _, want := range []string{
+		"+09:00:00.000  start  backup (run 3), overlapping report (run 3)\n",
+		"+24:00:00.000  stop   report (run 7)\n",
+		"report     7",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected the timeline to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestSimulateContention(t *testing.T) {
+	start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	cmds := []*ast.Command{
+		{Command: "tick", Name: "tick", Every: time.Second, Overlap: ast.OverlapReplace},
+		{Command: "a", Name: "a", Every: 10 * time.Second, Lock: "db"},
+		{Command: "b", Name: "b", Every: 10 * time.Second, Lock: "db"},
+		{Command: "c", Name: "c", Every: 10 * time.Second, Pool: "p"},
+		{Command: "d", Name: "d", Every: 10 * time.Second, Pool: "p"},
+	}
+	durations := map[string]time.Duration{"tick": 1500 * time.Millisecond, "a": 6 * time.Second, "b": 6 * time.Second, "c": 4 * time.Second, "d": 4 * time.Second}
+	r := NewRunner(ast.Settings{Pools: map[string]int{"p": 1}})
+	events, err := r.Simulate(cmds, start, time.Minute, func(cmd *ast.Command) time.Duration {
+		return durations[cmd.Name]
+	})
+	if err != nil {
+		t.Fatalf("Simulate returned error: %s", err)
+	}
+
+	began := make(map[string]time.Time)
+	ticks := 0
+	for _, e := range events {
+		key := fmt.Sprintf("%s %d", e.Job, e.Iter)
+		if e.Start {
+			began[key] = e.Time
+			if e.Job == "tick" {
+				ticks++
+			}
+			// the jobs sharing a lock or the pool take turns
+			for _, other := range e.Running {
+				pair := e.Job + strings.Fields(other)[0]
+				if pair == "ab" || pair == "ba" || pair == "cd" || pair == "dc" {
+					t.Errorf("expected %s (run %d) not to run alongside %s", e.Job, e.Iter, other)
+				}
+			}
+			continue
+		}
+		took := e.Time.Sub(began[key])
+		switch {
+		// every run of tick is replaced by the next one, or stopped by the end
+		case e.Job == "tick" && (!e.Stopped || took != time.Second && !e.Time.Equal(start.Add(time.Minute))):
+			t.Errorf("expected tick (run %d) to be stopped after 1s, it took %s (stopped: %v)", e.Iter, took, e.Stopped)
+		case e.Job != "tick" && !e.Stopped && took != durations[e.Job]:
+			t.Errorf("expected %s (run %d) to take %s, it took %s", e.Job, e.Iter, durations[e.Job], took)
+		}
+	}
+	if ticks != 61 {
+		t.Errorf("expected tick to start 61 times, got %d", ticks)
+	}
+}
+
+func TestSimulateSameJobs(t *testing.T) {
+	start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	cmds := []*ast.Command{
+		{Command: "echo", Args: []string{"a"}, Every: time.Hour},
+		{Command: "wait", Sync: true},
+		{Command: "echo", Args: []string{"a"}},
+	}
+	durations := []time.Duration{50 * time.Minute, 20 * time.Minute, 10 * time.Minute}
+	r := NewRunner(ast.Settings{})
+	events, err := r.Simulate(cmds, start, 90*time.Minute, func(cmd *ast.Command) time.Duration {
+		for i, x := range cmds {
+			if x == cmd {
+				return durations[i]
+			}
+		}
+		return 0
+	})
+	if err != nil {
+		t.Fatalf("Simulate returned error: %s", err)
+	}
+	for _, e := range events {
+		if e.Command != 1 && e.Job != fmt.Sprintf("echo a #%d", e.Command+1) {
+			t.Errorf("expected command %d to be told apart from the other echo a, got %q", e.Command, e.Job)
+		}
+		if e.Start && e.Command == 2 && !reflect.DeepEqual(e.Running, []string{"echo a #1 (run 1)"}) {
+			t.Errorf("expected echo a #3 to overlap echo a #1 (run 1), got %v", e.Running)
+		}
+	}
+
+	var buf strings.Builder
+	WriteSimulation(&buf, start, events)
+	for _, want := range []string{
+		"\necho a #1     2",
+		"  1h20m0s\n",
+		"\necho a #3     1            1  10m0s\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected the summary to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	cmds := []*ast.Command{
+		{Command: "sh", Line: 1, Stdout: []ast.Redirect{{Target: "out.log"}}},
+		{Command: "inscript-no-such-command", Line: 2, Stdout: []ast.Redirect{{Target: "out.log", Append: true}}, Stdin: "in.txt"},
+		{Command: "cat", Line: 3, Stdout: []ast.Redirect{{Target: "in.txt"}}, Sync: true, Every: time.Minute},
+		{Command: "sh", Line: 4, Stdout: []ast.Redirect{{Target: "locked.log"}}, Lock: "db"},
+		{Command: "sh", Line: 5, Stdout: []ast.Redirect{{Target: "locked.log"}}, Lock: "db"},
+		{Command: "sh", Line: 6, Stdout: []ast.Redirect{{Target: "{{.Iter}}.log"}}},
+		{Command: "sh", Line: 7, Stdout: []ast.Redirect{{Target: "{{.Iter}}.log"}}, Sync: true},
+	}
+	r := NewRunner(ast.Settings{})
+	r.Dir = dir
+	var got []string
+	for _, d := range r.Check(cmds) {
+		got = append(got, fmt.Sprintf("%d %s", d.Line, d.Severity))
+	}
+	want := []string{
+		"2 error",
+		"2 warning",
+		"3 warning",
+		"3 warning",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the diagnostics %v, got %v", want, got)
+	}
+	if ds := r.Check([]*ast.Command{{Command: "cat", Stdin: "@missing"}}); len(ds) != 1 || ds[0].Severity != SeverityError {
+		t.Errorf("expected an error for a reference to a missing job, got %+v", ds)
+	}
+
+	// a pool only one job may run in at once serializes its jobs, as a lock does
+	pooled := []*ast.Command{
+		{Command: "sh", Line: 1, Stdout: []ast.Redirect{{Target: "pool.log"}}, Pool: "one"},
+		{Command: "sh", Line: 2, Stdout: []ast.Redirect{{Target: "pool.log"}}, Pool: "one"},
+		{Command: "sh", Line: 3, Stdout: []ast.Redirect{{Target: "pool.log"}}, Pool: "two"},
+	}
+	r = NewRunner(ast.Settings{Pools: map[string]int{"one": 1, "two": 2}})
+	r.Dir = dir
+	if ds := r.Check(pooled); len(ds) != 2 || ds[0].Line != 3 || ds[1].Line != 3 {
+		t.Errorf("expected warnings only for the job outside the 1-slot pool, got %+v", ds)
+	}
+}
@@ -0,0 +1,215 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"github.com/insomnimus/inscript/ast"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SimEvent is a run of a job starting or ending in a simulation.
+type SimEvent struct {
+	Time time.Time
+	// Job is the name of the job, followed by #N, N being its position,
+	// if other jobs have the same name.
+	Job string
+	// Command is the index of the job in the simulated commands,
+	// which tells apart unnamed jobs with the same command line.
+	Command int
+	// Iter is the number of the run, starting at 1.
+	Iter  int
+	Start bool
+	// Stopped is set on the end of a run that was stopped before it finished,
+	// by overlap:= replace or by the end of the simulation.
+	Stopped bool
+	// Running are the other runs going on when a run starts.
+	Running []string
+}
+
+// Simulate runs the schedule of cmds on a simulated clock from start until start+span,
+// without starting any command.
+// Every run takes duration(cmd) of simulated time, or finishes instantly if duration is nil.
+// It returns the starts and ends of the runs in order, or the error Run would return.
+func (r *Runner) Simulate(cmds []*ast.Command, start time.Time, span time.Duration, duration func(*ast.Command) time.Duration) ([]SimEvent, error) {
+	clock := NewSimClock(start)
+	type run struct {
+		job  string
+		cmd  int
+		iter int
+	}
+	// jobs with the same name are told apart by their position
+	index := make(map[*ast.Command]int, len(cmds))
+	names := make([]string, len(cmds))
+	count := make(map[string]int)
+	for i, cmd := range cmds {
+		index[cmd] = i
+		names[i] = jobName(cmd)
+		count[names[i]]++
+	}
+	for i, name := range names {
+		if count[name] > 1 {
+			names[i] = fmt.Sprintf("%s #%d", name, i+1)
+		}
+	}
+	var (
+		mux     sync.Mutex
+		events  []SimEvent
+		running []*run
+	)
+	r.clock = clock
+	r.stub = func(ctx context.Context, cmd *ast.Command, iter int) error {
+		i := index[cmd]
+		self := &run{names[i], i, iter}
+		mux.Lock()
+		others := make([]string, 0, len(running))
+		for _, x := range running {
+			others = append(others, fmt.Sprintf("%s (run %d)", x.job, x.iter))
+		}
+		running = append(running, self)
+		events = append(events, SimEvent{
+			Time:    clock.Now(),
+			Job:     self.job,
+			Command: self.cmd,
+			Iter:    iter,
+			Start:   true,
+			Running: others,
+		})
+		mux.Unlock()
+
+		var d time.Duration
+		if duration != nil {
+			d = duration(cmd)
+		}
+		err := sleep(ctx, clock, d)
+
+		mux.Lock()
+		defer mux.Unlock()
+		for i, x := range running {
+			if x == self {
+				running = append(running[:i], running[i+1:]...)
+				break
+			}
+		}
+		events = append(events, SimEvent{
+			Time:    clock.Now(),
+			Job:     self.job,
+			Command: self.cmd,
+			Iter:    iter,
+			Stopped: err != nil,
+		})
+		return err
+	}
+	defer func() {
+		r.clock, r.stub = nil, nil
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	spawn(clock, func() {
+		done <- r.Run(ctx, cmds)
+	})
+
+	end := start.Add(span)
+	var err error
+loop:
+	for {
+		clock.Settle()
+		select {
+		case err = <-done:
+			break loop
+		default:
+		}
+		next, ok := clock.Next()
+		switch {
+		// nothing is left to wait for on the clock, so Run is returning
+		case !ok:
+			err = <-done
+			break loop
+		case next.After(end):
+			clock.Step(end)
+			cancel()
+			err = <-done
+			break loop
+		default:
+			clock.Step(next)
+		}
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events, err
+}
+
+// WriteSimulation writes the timeline of a simulation started at start to w,
+// followed by a summary of every job.
+func WriteSimulation(w io.Writer, start time.Time, events []SimEvent) {
+	type summary struct {
+		job               string
+		runs, overlapping int
+		busy              time.Duration
+	}
+	type run struct {
+		cmd, iter int
+	}
+	var (
+		jobs  []*summary
+		stats = make(map[int]*summary)
+		began = make(map[run]time.Time)
+	)
+	for _, e := range events {
+		s := stats[e.Command]
+		if s == nil {
+			s = &summary{job: e.Job}
+			stats[e.Command] = s
+			jobs = append(jobs, s)
+		}
+		key := run{e.Command, e.Iter}
+		at := offsetString(e.Time.Sub(start))
+		switch {
+		case e.Start:
+			s.runs++
+			began[key] = e.Time
+			if len(e.Running) > 0 {
+				s.overlapping++
+				fmt.Fprintf(w, "%s  start  %s (run %d), overlapping %s\n", at, e.Job, e.Iter, strings.Join(e.Running, ", "))
+			} else {
+				fmt.Fprintf(w, "%s  start  %s (run %d)\n", at, e.Job, e.Iter)
+			}
+		case e.Stopped:
+			s.busy += e.Time.Sub(began[key])
+			fmt.Fprintf(w, "%s  stop   %s (run %d)\n", at, e.Job, e.Iter)
+		default:
+			s.busy += e.Time.Sub(began[key])
+			fmt.Fprintf(w, "%s  end    %s (run %d)\n", at, e.Job, e.Iter)
+		}
+	}
+
+	if len(jobs) == 0 {
+		fmt.Fprintln(w, "no job would run")
+		return
+	}
+	width := len("job")
+	for _, s := range jobs {
+		if len(s.job) > width {
+			width = len(s.job)
+		}
+	}
+	fmt.Fprintf(w, "\n%-*s  runs  overlapping  busy\n", width, "job")
+	for _, s := range jobs {
+		fmt.Fprintf(w, "%-*s  %4d  %11d  %s\n", width, s.job, s.runs, s.overlapping, s.busy.Round(time.Millisecond))
+	}
+}
+
+// offsetString formats d as +hh:mm:ss.mmm.
+func offsetString(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("+%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,134 @@
+package runtime
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/insomnimus/inscript/ast"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is returned by LockScript when another instance of the script is running
+// and the mode is ast.SingletonExit.
+var ErrLocked = errors.New("another instance of the script is running")
+
+// LockPath returns the lock file guarding the script at the given path.
+// It's derived from the absolute path of the script so every copy of inscript agrees on it.
+func LockPath(script string) (string, error) {
+	abs, err := filepath.Abs(script)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	name := fmt.Sprintf("inscript-%s-%s.lock", filepath.Base(abs), hex.EncodeToString(sum[:8]))
+	return filepath.Join(os.TempDir(), name), nil
+}
+
+// LockScript takes the single-instance lock of the script at the given path.
+// If another instance holds it, mode decides what happens:
+// ast.SingletonExit returns ErrLocked, ast.SingletonWait waits for the other instance to finish
+// and ast.SingletonReplace interrupts the other instance and then waits for it.
+// The returned function releases the lock.
+func LockScript(ctx context.Context, script string, mode ast.Singleton) (release func(), err error) {
+	if mode == ast.SingletonOff {
+		return func() {}, nil
+	}
+	path, err := LockPath(script)
+	if err != nil {
+		return nil, err
+	}
+	interrupted := false
+	for {
+		f, holder, err := tryLockScript(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			return func() {
+				// cleared while the lock is still held, so it can't be taken for the next holder's
+				if pids, err := flockFile(context.Background(), pidPath(path)); err == nil {
+					pids.Truncate(0)
+					pids.Close()
+				}
+				f.Close()
+			}, nil
+		}
+		switch {
+		case mode == ast.SingletonExit:
+			return nil, ErrLocked
+		case mode == ast.SingletonReplace && !interrupted:
+			if err := interruptHolder(holder); err != nil {
+				return nil, fmt.Errorf("failed to stop the running instance: %w", err)
+			}
+			interrupted = true
+		}
+		if err := sleep(ctx, realClock{}, flockInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// tryLockScript tries to take the lock file at path without waiting.
+// It returns the locked file, or the pid of the process holding it, 0 if it can't be told.
+// The pid is recorded and read under the lock of its own file,
+// so it's always the one of the holder of the lock file.
+func tryLockScript(ctx context.Context, path string) (*os.File, int, error) {
+	pids, err := flockFile(ctx, pidPath(path))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer pids.Close()
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	ok, err := tryFlock(f)
+	if err != nil || !ok {
+		f.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+		// read through the locked file, as other handles can't read it on Windows
+		data, err := io.ReadAll(pids)
+		if err != nil {
+			return nil, 0, err
+		}
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		return nil, pid, nil
+	}
+	// record who holds the lock, for ast.SingletonReplace
+	if err := pids.Truncate(0); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if _, err := pids.WriteString(strconv.Itoa(os.Getpid())); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, 0, nil
+}
+
+// pidPath returns the file recording the pid of the process holding the lock file at path.
+// It's kept apart from the lock file, which can't be read while it's locked on Windows.
+func pidPath(path string) string {
+	return path + ".pid"
+}
+
+// interruptHolder interrupts the process holding the lock, whose pid is given.
+func interruptHolder(pid int) error {
+	if pid <= 0 {
+		return errors.New("the process holding the lock is unknown")
+	}
+	pr, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	interrupt(pr)
+	return nil
+}
@@ -0,0 +1,235 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"github.com/insomnimus/inscript/ast"
+	"io"
+	"os"
+	"sync"
+)
+
+// maxStream is how much a stream buffers for the job reading from it;
+// if the job falls further behind, the oldest output is dropped.
+const maxStream = 64 * 1024
+
+var errStopped = errors.New("stopped reading")
+
+// A stream carries the output of jobs to the stdin of another job, across all of their runs.
+// Writers never block: output is buffered until it's read.
+// Readers get io.EOF once every writer is done and the buffer is drained.
+// Once the reading job is done for good, what's written is discarded.
+type stream struct {
+	mux     sync.Mutex
+	buf     []byte
+	writers int
+	closed  bool
+	// closed and replaced whenever something changes
+	wake chan struct{}
+}
+
+func newStream() *stream {
+	return &stream{wake: make(chan struct{})}
+}
+
+// notify wakes up the readers.
+// s.mux must be held.
+func (s *stream) notify() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed {
+		return len(p), nil
+	}
+	s.buf = append(s.buf, p...)
+	if n := len(s.buf) - maxStream; n > 0 {
+		s.buf = append(s.buf[:0], s.buf[n:]...)
+	}
+	s.notify()
+	return len(p), nil
+}
+
+// done unregisters a writer.
+func (s *stream) done() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.writers--
+	s.notify()
+}
+
+// close discards the buffered output and anything written from now on.
+func (s *stream) close() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.closed = true
+	s.buf = nil
+	s.notify()
+}
+
+// read reads buffered output into p, waiting for some if there's none.
+// It returns io.EOF once every writer is done and errStopped if stop is closed first.
+func (s *stream) read(p []byte, stop <-chan struct{}) (int, error) {
+	for {
+		s.mux.Lock()
+		if len(s.buf) > 0 {
+			n := copy(p, s.buf)
+			s.buf = append(s.buf[:0], s.buf[n:]...)
+			s.mux.Unlock()
+			return n, nil
+		}
+		if s.writers <= 0 || s.closed {
+			s.mux.Unlock()
+			return 0, io.EOF
+		}
+		wake := s.wake
+		s.mux.Unlock()
+		select {
+		case <-wake:
+		case <-stop:
+			return 0, errStopped
+		}
+	}
+}
+
+// pipe returns the stdin of a run reading from s.
+// Output is copied from s until stop is closed; what the run didn't read by then is lost.
+func (s *stream) pipe(stop <-chan struct{}) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer w.Close()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := s.read(buf, stop)
+			if err != nil {
+				return
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	return r, nil
+}
+
+// jobStreams holds the streams between the jobs of a script.
+type jobStreams struct {
+	// the jobs by name
+	named map[string]*ast.Command
+	// the stream a job reads from
+	in map[*ast.Command]*stream
+	// the streams fed by a job's stdout because another job has it as its stdin
+	feeds map[*ast.Command][]*stream
+}
+
+// jobRef returns the name of the job s refers to, as in @name.
+func jobRef(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '@' {
+		return "", false
+	}
+	return s[1:], true
+}
+
+// connect sets up the streams between cmds, for every stdin:= @job and stdout:= @job.
+// It returns nil if there are none.
+func connect(cmds []*ast.Command) (*jobStreams, error) {
+	js := &jobStreams{
+		named: make(map[string]*ast.Command),
+		in:    make(map[*ast.Command]*stream),
+		feeds: make(map[*ast.Command][]*stream),
+	}
+	index := make(map[*ast.Command]int, len(cmds))
+	for i, cmd := range cmds {
+		index[cmd] = i
+		if cmd.Name == "" {
+			continue
+		}
+		if _, ok := js.named[cmd.Name]; ok {
+			js.named[cmd.Name] = nil
+		} else {
+			js.named[cmd.Name] = cmd
+		}
+	}
+	lookup := func(cmd *ast.Command, name string) (*ast.Command, error) {
+		job, ok := js.named[name]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("command %s: there's no job named %q", jobName(cmd), name)
+		case job == nil:
+			return nil, fmt.Errorf("command %s: there are several jobs named %q", jobName(cmd), name)
+		case job == cmd:
+			return nil, fmt.Errorf("command %s: a job can't read its own output", jobName(cmd))
+		}
+		return job, nil
+	}
+	// link makes the output of from go to the stdin of to
+	link := func(from, to *ast.Command) (*stream, error) {
+		// the runner would wait for the reader to finish before starting the writer
+		if index[to] < index[from] && !isAsync(to) {
+			return nil, fmt.Errorf("command %s: the sync job reading from %s must come after it", jobName(to), jobName(from))
+		}
+		if _, ok := jobRef(to.Stdin); (to.Stdin != "" && !ok) || to.Input != "" {
+			return nil, fmt.Errorf("command %s: a job reading from %s can't have another stdin", jobName(to), jobName(from))
+		}
+		s, ok := js.in[to]
+		if !ok {
+			s = newStream()
+			js.in[to] = s
+		}
+		s.writers++
+		return s, nil
+	}
+
+	for _, cmd := range cmds {
+		if name, ok := jobRef(cmd.Stdin); ok {
+			from, err := lookup(cmd, name)
+			if err != nil {
+				return nil, err
+			}
+			s, err := link(from, cmd)
+			if err != nil {
+				return nil, err
+			}
+			js.feeds[from] = append(js.feeds[from], s)
+		}
+		for _, rs := range [][]ast.Redirect{cmd.Stdout, cmd.Stderr} {
+			for _, r := range rs {
+				name, ok := jobRef(r.Target)
+				if !ok {
+					continue
+				}
+				to, err := lookup(cmd, name)
+				if err != nil {
+					return nil, err
+				}
+				if _, err := link(cmd, to); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if len(js.in) == 0 {
+		return nil, nil
+	}
+	return js, nil
+}
+
+// stream returns the stream the job called name reads from.
+func (js *jobStreams) stream(name string) (*stream, error) {
+	if js == nil {
+		return nil, fmt.Errorf("@%s: jobs can only be referred to when running a script", name)
+	}
+	return js.in[js.named[name]], nil
+}
+
+// isAsync reports whether cmd runs in the background.
+func isAsync(cmd *ast.Command) bool {
+	// repeating forever is always async
+	return !cmd.Sync || (cmd.Every > 0 && cmd.Times == 0)
+}
@@ -0,0 +1,48 @@
+package runtime
+
+import (
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateTarget is a redirect target whose path is evaluated for every run.
+type templateTarget struct {
+	tmpl       *template.Template
+	appendMode bool
+}
+
+func (templateTarget) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// runData is what the templates of a run are evaluated with.
+type runData struct {
+	// Name is the name of the job, or its command line if it has no name.
+	Name string
+	// Iter is the number of the run, starting at 1.
+	Iter int
+	now  time.Time
+}
+
+// Time formats the time the run was prepared with the given layout.
+func (d runData) Time(layout string) string {
+	return d.now.Format(layout)
+}
+
+// isTemplate reports whether s has template actions.
+func isTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+func parseTemplate(s string) (*template.Template, error) {
+	return template.New(s).Option("missingkey=error").Parse(s)
+}
+
+func (d runData) execute(tmpl *template.Template) (string, error) {
+	var buff strings.Builder
+	if err := tmpl.Execute(&buff, d); err != nil {
+		return "", err
+	}
+	return buff.String(), nil
+}
@@ -0,0 +1,307 @@
+// Package syntax parses scripts into a tree that keeps their comments, blank lines and quoting,
+// for tools that print or inspect scripts instead of running them.
+// Variables and command substitutions are left as they are written.
+package syntax
+
+import (
+	"fmt"
+	"github.com/insomnimus/inscript/lexer"
+	"github.com/insomnimus/inscript/token"
+)
+
+// File is a parsed script.
+type File struct {
+	Nodes []Node
+}
+
+// Node is a statement of a file or a line in a command block:
+// a *Blank, *Comment, *Variable, *Command or *Field.
+type Node interface {
+	// Pos returns the line the node starts on.
+	Pos() int
+}
+
+// Blank is an empty line.
+type Blank struct {
+	Line int
+}
+
+// Comment is a comment, including directives such as #<sync=true>.
+type Comment struct {
+	// Text is the comment as written, from the '#'.
+	Text string
+	Line int
+}
+
+// Word is a word of a statement.
+type Word struct {
+	// Raw is the word as written, with its quotes.
+	Raw string
+	// Value is the word with its quotes and escape sequences removed.
+	Value string
+	Line  int
+}
+
+// Variable is a variable assignment, such as x:=42.
+type Variable struct {
+	Name Word
+	// Value is nil if nothing is assigned.
+	Value   *Word
+	Comment *Comment
+}
+
+// Command is an inline command or an @ command block.
+type Command struct {
+	// Words are the command and its arguments; the first may carry the ':', '!' and '+' prefixes.
+	Words []Word
+	Block bool
+	// Body holds the fields, comments and blank lines of a block.
+	Body []Node
+	// Comment is the comment at the end of the line of an inline command or of the '{' of a block.
+	Comment *Comment
+	// EndLine is the line of the '}' of a block, and EndComment the comment after it.
+	EndLine    int
+	EndComment *Comment
+	Line       int
+}
+
+// Field is a field of a command block.
+type Field struct {
+	Key Word
+	// Values are the words of the value; references to jobs start with '@'.
+	Values []Word
+	// Heredoc is set if the value is a here-document, whose source is the only value.
+	Heredoc bool
+	Comment *Comment
+}
+
+func (n *Blank) Pos() int    { return n.Line }
+func (n *Comment) Pos() int  { return n.Line }
+func (n *Variable) Pos() int { return n.Name.Line }
+func (n *Command) Pos() int  { return n.Line }
+func (n *Field) Pos() int    { return n.Key.Line }
+
+type parser struct {
+	l           *lexer.Lexer
+	token, peek token.Token
+}
+
+// Parse parses the script in src.
+func Parse(src string) (*File, error) {
+	p := &parser{l: lexer.NewMode(src, lexer.Raw)}
+	if err := p.read(); err != nil {
+		return nil, err
+	}
+	if err := p.read(); err != nil {
+		return nil, err
+	}
+	f := &File{}
+	nodes, err := p.parseNodes(token.EOF)
+	if err != nil {
+		return nil, err
+	}
+	f.Nodes = nodes
+	return f, nil
+}
+
+func (p *parser) read() error {
+	p.token = p.peek
+	var err error
+	p.peek, err = p.l.Next()
+	return err
+}
+
+// parseNodes parses the statements of a file or the lines of a block, up to the end token.
+func (p *parser) parseNodes(end token.TokenType) ([]Node, error) {
+	var nodes []Node
+	// whether nothing has been read on the current line
+	empty := true
+	for p.token.Type != end {
+		var (
+			n   Node
+			err error
+		)
+		switch p.token.Type {
+		case token.LF:
+			if empty {
+				nodes = append(nodes, &Blank{Line: p.token.Line})
+			}
+			empty = true
+			if err := p.read(); err != nil {
+				return nil, err
+			}
+			continue
+		case token.Comment:
+			n = p.comment()
+			err = p.read()
+		case token.String:
+			switch {
+			case end == token.RBrace:
+				n, err = p.parseField()
+			case p.peek.Type == token.Assign:
+				n, err = p.parseVariable()
+			default:
+				n, err = p.parseInline()
+			}
+		case token.At:
+			if end == token.EOF {
+				n, err = p.parseBlock()
+				break
+			}
+			fallthrough
+		default:
+			if p.token.Type == token.EOF {
+				return nil, fmt.Errorf("unexpected end of file in command block")
+			}
+			return nil, fmt.Errorf("line %d: unexpected token of type %s", p.token.Line, p.token.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+		empty = false
+	}
+	return nodes, nil
+}
+
+func (p *parser) comment() *Comment {
+	return &Comment{Text: p.token.Raw, Line: p.token.Line}
+}
+
+func (p *parser) word() Word {
+	return Word{Raw: p.token.Raw, Value: p.token.Literal, Line: p.token.Line}
+}
+
+// trailing reads the comment at the end of the current line, if any.
+func (p *parser) trailing() (*Comment, error) {
+	if p.token.Type != token.Comment {
+		return nil, nil
+	}
+	c := p.comment()
+	return c, p.read()
+}
+
+func (p *parser) parseVariable() (*Variable, error) {
+	v := &Variable{Name: p.word()}
+	if err := p.read(); err != nil {
+		return nil, err
+	}
+	if err := p.read(); err != nil {
+		return nil, err
+	}
+	switch p.token.Type {
+	case token.String:
+		w := p.word()
+		v.Value = &w
+		if err := p.read(); err != nil {
+			return nil, err
+		}
+	case token.LF, token.EOF, token.Comment:
+	default:
+		return nil, fmt.Errorf("line %d: can't assign %s to a variable, the value has to be a string", p.token.Line, p.token.Literal)
+	}
+	var err error
+	v.Comment, err = p.trailing()
+	return v, err
+}
+
+func (p *parser) parseWords() ([]Word, error) {
+	var words []Word
+	for p.token.Type == token.String {
+		words = append(words, p.word())
+		if err := p.read(); err != nil {
+			return nil, err
+		}
+	}
+	return words, nil
+}
+
+func (p *parser) parseInline() (*Command, error) {
+	cmd := &Command{Line: p.token.Line}
+	var err error
+	if cmd.Words, err = p.parseWords(); err != nil {
+		return nil, err
+	}
+	cmd.Comment, err = p.trailing()
+	return cmd, err
+}
+
+func (p *parser) parseBlock() (*Command, error) {
+	cmd := &Command{Line: p.token.Line, Block: true}
+	if err := p.read(); err != nil {
+		return nil, err
+	}
+	if p.token.Type != token.String {
+		return nil, fmt.Errorf("line %d: unexpected token %s, expected %s instead", p.token.Line, p.token.Type, token.String)
+	}
+	var err error
+	if cmd.Words, err = p.parseWords(); err != nil {
+		return nil, err
+	}
+	if p.token.Type != token.LBrace {
+		return nil, fmt.Errorf("line %d: expected left brace, got %s instead", p.token.Line, p.token.Type)
+	}
+	if err := p.read(); err != nil {
+		return nil, err
+	}
+	if cmd.Comment, err = p.trailing(); err != nil {
+		return nil, err
+	}
+	// the line feed after '{' doesn't make a blank line
+	if p.token.Type == token.LF {
+		if err := p.read(); err != nil {
+			return nil, err
+		}
+	}
+	if cmd.Body, err = p.parseNodes(token.RBrace); err != nil {
+		return nil, err
+	}
+	cmd.EndLine = p.token.Line
+	if err := p.read(); err != nil {
+		return nil, err
+	}
+	cmd.EndComment, err = p.trailing()
+	return cmd, err
+}
+
+func (p *parser) parseField() (*Field, error) {
+	f := &Field{Key: p.word()}
+	if p.peek.Type != token.Assign {
+		return nil, fmt.Errorf("line %d: unexpected token %s, expected %s instead", p.peek.Line, p.peek.Type, token.Assign)
+	}
+	if err := p.read(); err != nil {
+		return nil, err
+	}
+	if err := p.read(); err != nil {
+		return nil, err
+	}
+	if p.token.Type == token.Heredoc {
+		f.Values = []Word{p.word()}
+		f.Heredoc = true
+		return f, p.read()
+	}
+	for p.token.Type == token.String || p.token.Type == token.At {
+		if p.token.Type == token.At {
+			at := p.token
+			if err := p.read(); err != nil {
+				return nil, err
+			}
+			if p.token.Type != token.String {
+				return nil, fmt.Errorf("line %d: unexpected token %s, expected %s instead", p.token.Line, p.token.Type, token.String)
+			}
+			f.Values = append(f.Values, Word{
+				Raw:   "@" + p.token.Raw,
+				Value: "@" + p.token.Literal,
+				Line:  at.Line,
+			})
+		} else {
+			f.Values = append(f.Values, p.word())
+		}
+		if err := p.read(); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	f.Comment, err = p.trailing()
+	return f, err
+}
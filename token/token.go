@@ -17,12 +17,15 @@ const (
 	Comment
 	String
 	Assign
+	Heredoc
 )
 
 type Token struct {
 	Type    TokenType
 	Literal string
 	Line    int
+	// the source text of the token, only set by lexers in raw mode
+	Raw string
 }
 
 func (t Token) GoString() string {
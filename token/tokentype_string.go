@@ -17,11 +17,12 @@ func _() {
 	_ = x[Comment-7]
 	_ = x[String-8]
 	_ = x[Assign-9]
+	_ = x[Heredoc-10]
 }
 
-const _TokenType_name = "İllegalEOFLFAtLBraceRBraceCommentStringAssign"
+const _TokenType_name = "İllegalEOFLFAtLBraceRBraceCommentStringAssignHeredoc"
 
-var _TokenType_index = [...]uint8{0, 8, 11, 13, 15, 21, 27, 34, 40, 46}
+var _TokenType_index = [...]uint8{0, 8, 11, 13, 15, 21, 27, 34, 40, 46, 53}
 
 func (i TokenType) String() string {
 	i -= 1